@@ -0,0 +1,1060 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CalDAV (RFC 4791): every user has a calendar collection at
+// /v1/caldav/<user_id>/ holding their bookings, one resource per booking.
+// Calendar clients can list and read them through PROPFIND, REPORT and GET,
+// create bookings through PUT, which are validated the same way book-slot
+// does, move the ones they organize and cancel them through DELETE
+const (
+	davNamespace    = "DAV:"
+	caldavNamespace = "urn:ietf:params:xml:ns:caldav"
+	csNamespace     = "http://calendarserver.org/ns/"
+)
+
+// caldavSearchEvery is the search interval CalDAV bookings are looked up
+// with, every minute so that an event is checked at its exact start rather
+// than on the grid book-slot searches
+const caldavSearchEvery = 1
+
+// davProperty is a property named in a PROPFIND or REPORT body
+type davProperty struct {
+	XMLName xml.Name
+}
+
+type davPropfindInput struct {
+	AllProp *struct{} `xml:"DAV: allprop"`
+	Prop    struct {
+		Names []davProperty `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type caldavTimeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type caldavCompFilter struct {
+	Name      string             `xml:"name,attr"`
+	TimeRange *caldavTimeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	Filters   []caldavCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// caldavReportInput is a calendar-query or a calendar-multiget report
+type caldavReportInput struct {
+	XMLName xml.Name
+	Prop    struct {
+		Names []davProperty `xml:",any"`
+	} `xml:"DAV: prop"`
+	Hrefs  []string `xml:"DAV: href"`
+	Filter struct {
+		CompFilter caldavCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	} `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+// calendarObject is the UID and resource name of a booking
+type calendarObject struct {
+	UID  string
+	Name string
+}
+
+// caldavEvent is a booking as a resource of a user's collection
+type caldavEvent struct {
+	slot   scheduledSlot
+	object calendarObject
+}
+
+func caldavCollectionHref(user int) string {
+	return fmt.Sprintf("/v1/caldav/%d/", user)
+}
+
+// etag changes whenever the booking is moved, cancelled or its attendees
+// change
+func (event caldavEvent) etag() string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(event.slot.ID, event.slot.StartsAt, event.slot.EndsAt, event.slot.Attendees, event.slot.CancelledAt, event.object.UID)))
+	return fmt.Sprintf("\"%x\"", sum[:8])
+}
+
+// calendarData is the iCalendar object of the event, as seen by user
+func (event caldavEvent) calendarData(user int, userContact func(int) contact) string {
+	var calendar strings.Builder
+	writeICSLine(&calendar, "BEGIN:VCALENDAR")
+	writeICSLine(&calendar, "VERSION:2.0")
+	writeICSLine(&calendar, "PRODID:-//calenderapi//bookings//EN")
+	writeBookingEvent(&calendar, event.slot, event.object.UID, user, userContact)
+	writeICSLine(&calendar, "END:VCALENDAR")
+	return calendar.String()
+}
+
+// getCalDAVObjects reads the UIDs and resource names of the bookings of user,
+// keyed by booking id. Bookings missing from it use their defaults
+func getCalDAVObjects(q querier, user int) (map[int]calendarObject, error) {
+	rows, err := q.Query(getUserCalDAVObjects, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := make(map[int]calendarObject)
+	for rows.Next() {
+		var id int
+		var object calendarObject
+		if err = rows.Scan(&id, &object.UID, &object.Name); err != nil {
+			return nil, err
+		}
+		objects[id] = object
+	}
+	return objects, rows.Err()
+}
+
+// getCalDAVEvents reads the bookings of user that are not cancelled
+func getCalDAVEvents(q querier, user int) ([]caldavEvent, error) {
+	objects, err := getCalDAVObjects(q, user)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(getUserAllBookedSlots, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []caldavEvent
+	for rows.Next() {
+		slot, err := scanScheduledSlot(rows)
+		if err != nil {
+			return nil, err
+		}
+		if slot.CancelledAt != "" {
+			continue
+		}
+		events = append(events, caldavEvent{slot: slot, object: calendarObjectOf(objects, slot.ID)})
+	}
+	return events, rows.Err()
+}
+
+// calendarObjectOf falls back on the booking's default UID and resource name
+func calendarObjectOf(objects map[int]calendarObject, id int) calendarObject {
+	if object, ok := objects[id]; ok {
+		return object
+	}
+	return calendarObject{UID: bookingUID(id), Name: fmt.Sprintf("booking-%d.ics", id)}
+}
+
+// getCalDAVEvent looks up the resource name in the collection of user, it
+// reports false when there's no such booking, or it's cancelled
+func getCalDAVEvent(q querier, user int, name string) (caldavEvent, bool, error) {
+	var id int
+	err := q.QueryRow(getCalDAVObjectByName, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := fmt.Sscanf(name, "booking-%d.ics", &id); err != nil {
+			return caldavEvent{}, false, nil
+		}
+	} else if err != nil {
+		return caldavEvent{}, false, err
+	}
+
+	slot, err := scanScheduledSlot(q.QueryRow(getBookedSlot, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return caldavEvent{}, false, nil
+	}
+	if err != nil {
+		return caldavEvent{}, false, err
+	}
+	for _, attendee := range slot.Attendees {
+		if attendee == user {
+			objects, err := getCalDAVObjects(q, user)
+			if err != nil {
+				return caldavEvent{}, false, err
+			}
+			event := caldavEvent{slot: slot, object: calendarObjectOf(objects, slot.ID)}
+			return event, event.object.Name == name, nil
+		}
+	}
+	return caldavEvent{}, false, nil
+}
+
+// parseCalDAVEvent reads the single VEVENT of a PUT body, along with the
+// users of this service it names as ORGANIZER or ATTENDEE, by email or by
+// the address userCalAddress gives them. Times are read in loc when floating
+func parseCalDAVEvent(q querier, content string, loc *time.Location) (icsEvent, []int, error) {
+	lines := unfoldICS(content)
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return icsEvent{}, nil, errors.New("not an iCalendar object, it has to start with BEGIN:VCALENDAR")
+	}
+
+	var props []icsProperty
+	var components []string
+	events := 0
+	for _, line := range lines {
+		prop, ok := parseICSProperty(line)
+		if !ok {
+			continue
+		}
+		switch prop.Name {
+		case "BEGIN":
+			components = append(components, strings.ToUpper(prop.Value))
+			if strings.EqualFold(prop.Value, "VEVENT") {
+				events++
+			}
+		case "END":
+			if len(components) > 0 {
+				components = components[:len(components)-1]
+			}
+		default:
+			// properties of nested components, such as VALARM, are left out
+			if len(components) == 2 && components[1] == "VEVENT" {
+				props = append(props, prop)
+			}
+		}
+	}
+	if events != 1 {
+		return icsEvent{}, nil, errors.New("the calendar object has to hold exactly one VEVENT")
+	}
+
+	event, ok, err := icsEventFrom(props, loc)
+	if err != nil {
+		return event, nil, err
+	}
+	if !ok {
+		return event, nil, errors.New("cancelled, transparent or empty events can't be booked")
+	}
+	if event.UID == "" {
+		return event, nil, errors.New("VEVENT without a UID")
+	}
+	if event.Rule != "" || !event.RecurrenceID.IsZero() {
+		return event, nil, errors.New("recurring events can't be booked over CalDAV, kindly use /v1/user/book-slot")
+	}
+
+	var users []int
+	for _, prop := range props {
+		if prop.Name != "ATTENDEE" && prop.Name != "ORGANIZER" {
+			continue
+		}
+		if user, ok := parseUserCalAddress(prop.Value); ok {
+			users = append(users, user)
+			continue
+		}
+		address := strings.TrimSpace(prop.Value)
+		if len(address) <= len("mailto:") || !strings.EqualFold(address[:len("mailto:")], "mailto:") {
+			continue
+		}
+		var user int
+		err := q.QueryRow(getUserByEmail, address[len("mailto:"):]).Scan(&user)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return event, nil, fmt.Errorf("unable to look up %s", address)
+		}
+		users = append(users, user)
+	}
+	return event, users, nil
+}
+
+// caldavProp renders a property of the collection of user, or of event when
+// set. It reports false for properties it doesn't have
+func caldavProp(name xml.Name, user int, event *caldavEvent, ctag string, userContact func(int) contact) (string, bool) {
+	switch {
+	case name.Space == davNamespace && name.Local == "resourcetype":
+		if event != nil {
+			return "<D:resourcetype/>", true
+		}
+		return "<D:resourcetype><D:collection/><C:calendar/></D:resourcetype>", true
+	case name.Space == davNamespace && name.Local == "displayname" && event == nil:
+		return "<D:displayname>" + escapeXML(userContact(user).Name) + "</D:displayname>", true
+	case name.Space == davNamespace && name.Local == "current-user-principal":
+		return "<D:current-user-principal><D:href>" + caldavCollectionHref(user) + "</D:href></D:current-user-principal>", true
+	case name.Space == davNamespace && name.Local == "supported-report-set" && event == nil:
+		return "<D:supported-report-set><D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report><D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report></D:supported-report-set>", true
+	case name.Space == csNamespace && name.Local == "getctag" && event == nil:
+		return "<CS:getctag>" + ctag + "</CS:getctag>", true
+	case name.Space == caldavNamespace && name.Local == "supported-calendar-component-set" && event == nil:
+		return `<C:supported-calendar-component-set><C:comp name="VEVENT"/></C:supported-calendar-component-set>`, true
+	case name.Space == davNamespace && name.Local == "getetag" && event != nil:
+		return "<D:getetag>" + escapeXML(event.etag()) + "</D:getetag>", true
+	case name.Space == davNamespace && name.Local == "getcontenttype" && event != nil:
+		return "<D:getcontenttype>text/calendar; charset=utf-8; component=vevent</D:getcontenttype>", true
+	case name.Space == caldavNamespace && name.Local == "calendar-data" && event != nil:
+		return "<C:calendar-data>" + escapeXML(event.calendarData(user, userContact)) + "</C:calendar-data>", true
+	}
+	return "", false
+}
+
+// caldavAllProps are the properties listed for an allprop PROPFIND
+var caldavAllProps = []xml.Name{
+	{Space: davNamespace, Local: "resourcetype"},
+	{Space: davNamespace, Local: "displayname"},
+	{Space: davNamespace, Local: "getetag"},
+	{Space: davNamespace, Local: "getcontenttype"},
+	{Space: csNamespace, Local: "getctag"},
+	{Space: caldavNamespace, Local: "supported-calendar-component-set"},
+}
+
+// writeDAVResponse writes the response element of href to a multistatus,
+// with the properties found and the ones missing in their own propstat
+func writeDAVResponse(b *strings.Builder, href string, names []xml.Name, allProp bool, user int, event *caldavEvent, ctag string, userContact func(int) contact) {
+	var found, missing strings.Builder
+	for _, name := range names {
+		if value, ok := caldavProp(name, user, event, ctag, userContact); ok {
+			found.WriteString(value)
+		} else if !allProp {
+			fmt.Fprintf(&missing, `<%s xmlns="%s"/>`, name.Local, escapeXML(name.Space))
+		}
+	}
+	b.WriteString("<D:response><D:href>" + escapeXML(href) + "</D:href>")
+	if found.Len() > 0 {
+		b.WriteString("<D:propstat><D:prop>" + found.String() + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+	}
+	if missing.Len() > 0 {
+		b.WriteString("<D:propstat><D:prop>" + missing.String() + "</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+	}
+	b.WriteString("</D:response>")
+}
+
+// writeMultistatus sends the response elements as a 207 multistatus
+func writeMultistatus(c *gin.Context, responses string) {
+	body := `<?xml version="1.0" encoding="utf-8"?>` +
+		`<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/">` +
+		responses + "</D:multistatus>"
+	c.Data(http.StatusMultiStatus, "application/xml; charset=utf-8", []byte(body))
+}
+
+func escapeXML(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+// caldavCtag changes whenever any of the events does
+func caldavCtag(events []caldavEvent) string {
+	hash := sha256.New()
+	for _, event := range events {
+		io.WriteString(hash, event.object.Name+event.etag())
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)[:8])
+}
+
+// caldavPasswordInput asks for a new CalDAV password of a user
+type caldavPasswordInput struct {
+	UserID int `json:"user_id"`
+}
+
+// hashCalDAVPassword is how a CalDAV password is stored, passwords being
+// random they need no salt
+func hashCalDAVPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// setCalDAVPassword generates the password the user signs in to CalDAV with,
+// replacing the former one. It is only shown in this response
+func setCalDAVPassword(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var input caldavPasswordInput
+	if err = json.Unmarshal(jsonData, &input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+	password := randomHex(16)
+	res, err := db.Exec(updateUserCalDAVPassword, hashCalDAVPassword(password), input.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to set the password",
+		})
+		return
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "user not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"username": strconv.Itoa(input.UserID),
+		"password": password,
+	})
+}
+
+// caldavPrincipal reads the user signing in with username, their id or
+// email, and password. It reports false when they don't match
+func caldavPrincipal(q querier, username, password string) (int, bool) {
+	user, err := strconv.Atoi(username)
+	if err != nil {
+		err = q.QueryRow(getUserByEmail, username).Scan(&user)
+	}
+	var stored string
+	if err == nil {
+		err = q.QueryRow(getUserCalDAVPassword, user).Scan(&stored)
+	}
+	if err != nil || stored == "" {
+		return 0, false
+	}
+	return user, subtle.ConstantTimeCompare([]byte(hashCalDAVPassword(password)), []byte(stored)) == 1
+}
+
+// caldavUser authenticates the request with the Basic credentials of a user,
+// who can only reach their own collection. It replies 401 when the
+// credentials are missing or wrong and 403 for the collection of another user
+func caldavUser(c *gin.Context, q querier) (int, bool) {
+	username, password, ok := c.Request.BasicAuth()
+	user := 0
+	if ok {
+		user, ok = caldavPrincipal(q, username, password)
+	}
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="calenderapi", charset="UTF-8"`)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status":  "error",
+			"message": "invalid credentials",
+		})
+		return 0, false
+	}
+	if c.Param("id") != strconv.Itoa(user) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"status":  "error",
+			"message": "the calendar belongs to another user",
+		})
+		return 0, false
+	}
+	return user, true
+}
+
+// caldavOptions advertises CalDAV support
+func caldavOptions(c *gin.Context) {
+	c.Header("DAV", "1, calendar-access")
+	c.Header("Allow", "OPTIONS, PROPFIND, REPORT, GET, PUT, DELETE")
+	c.Status(http.StatusOK)
+}
+
+// caldavPropfind lists the properties of the collection, along with its
+// events for Depth: 1, or of a single event
+func caldavPropfind(c *gin.Context) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	user, ok := caldavUser(c, db)
+	if !ok {
+		return
+	}
+
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	// an empty body asks for all the properties
+	var propfind davPropfindInput
+	if len(strings.TrimSpace(string(jsonData))) > 0 {
+		if err = xml.Unmarshal(jsonData, &propfind); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "invalid PROPFIND body",
+			})
+			return
+		}
+	}
+	allProp := propfind.AllProp != nil || len(propfind.Prop.Names) == 0
+	names := caldavAllProps
+	if !allProp {
+		names = nil
+		for _, prop := range propfind.Prop.Names {
+			names = append(names, prop.XMLName)
+		}
+	}
+
+	userContact := userContacts(db)
+
+	var responses strings.Builder
+	if name := c.Param("name"); name != "" {
+		event, found, err := getCalDAVEvent(db, user, name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to get booked slots",
+			})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": "event not found",
+			})
+			return
+		}
+		writeDAVResponse(&responses, caldavCollectionHref(user)+name, names, allProp, user, &event, "", userContact)
+		writeMultistatus(c, responses.String())
+		return
+	}
+
+	events, err := getCalDAVEvents(db, user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get booked slots",
+		})
+		return
+	}
+	writeDAVResponse(&responses, caldavCollectionHref(user), names, allProp, user, nil, caldavCtag(events), userContact)
+	if c.GetHeader("Depth") != "0" {
+		for i := range events {
+			writeDAVResponse(&responses, caldavCollectionHref(user)+events[i].object.Name, names, allProp, user, &events[i], "", userContact)
+		}
+	}
+	writeMultistatus(c, responses.String())
+}
+
+// caldavReport answers calendar-query reports, optionally limited to a
+// time-range of VEVENTs, and calendar-multiget reports
+func caldavReport(c *gin.Context) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	user, ok := caldavUser(c, db)
+	if !ok {
+		return
+	}
+
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	var report caldavReportInput
+	if err = xml.Unmarshal(jsonData, &report); err != nil || report.XMLName.Space != caldavNamespace {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid REPORT body",
+		})
+		return
+	}
+	if report.XMLName.Local != "calendar-query" && report.XMLName.Local != "calendar-multiget" {
+		c.JSON(http.StatusForbidden, gin.H{
+			"status":  "error",
+			"message": "only calendar-query and calendar-multiget reports are supported",
+		})
+		return
+	}
+	var names []xml.Name
+	for _, prop := range report.Prop.Names {
+		names = append(names, prop.XMLName)
+	}
+
+	// the query only matches VEVENTs, within the time-range when given
+	var window *timeRange
+	matchesEvents := true
+	if filter := report.Filter.CompFilter; report.XMLName.Local == "calendar-query" && len(filter.Filters) > 0 {
+		matchesEvents = false
+		for _, child := range filter.Filters {
+			if !strings.EqualFold(child.Name, "VEVENT") {
+				continue
+			}
+			matchesEvents = true
+			if child.TimeRange == nil {
+				continue
+			}
+			// a missing start or end leaves the range open on that side
+			window = &timeRange{End: time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)}
+			if start, err := time.Parse("20060102T150405Z", child.TimeRange.Start); err == nil {
+				window.Start = start
+			}
+			if end, err := time.Parse("20060102T150405Z", child.TimeRange.End); err == nil {
+				window.End = end
+			}
+		}
+	}
+
+	userContact := userContacts(db)
+
+	events, err := getCalDAVEvents(db, user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get booked slots",
+		})
+		return
+	}
+
+	var responses strings.Builder
+	if report.XMLName.Local == "calendar-multiget" {
+		byHref := make(map[string]*caldavEvent)
+		for i := range events {
+			byHref[caldavCollectionHref(user)+events[i].object.Name] = &events[i]
+		}
+		for _, href := range report.Hrefs {
+			href = strings.TrimSpace(href)
+			if u, err := url.Parse(href); err == nil {
+				href = u.Path
+			}
+			event, ok := byHref[href]
+			if !ok {
+				responses.WriteString("<D:response><D:href>" + escapeXML(href) + "</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>")
+				continue
+			}
+			writeDAVResponse(&responses, href, names, false, user, event, "", userContact)
+		}
+		writeMultistatus(c, responses.String())
+		return
+	}
+
+	for i := range events {
+		booked, err := events[i].slot.timeRange()
+		if err != nil || !matchesEvents || (window != nil && !booked.overlaps(*window)) {
+			continue
+		}
+		writeDAVResponse(&responses, caldavCollectionHref(user)+events[i].object.Name, names, false, user, &events[i], "", userContact)
+	}
+	writeMultistatus(c, responses.String())
+}
+
+// caldavGetEvent serves a booking as an iCalendar object
+func caldavGetEvent(c *gin.Context) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	user, ok := caldavUser(c, db)
+	if !ok {
+		return
+	}
+	event, found, err := getCalDAVEvent(db, user, c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get booked slots",
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "error",
+			"message": "event not found",
+		})
+		return
+	}
+
+	c.Header("ETag", event.etag())
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(event.calendarData(user, userContacts(db))))
+}
+
+// caldavPutEvent books a new event of the collection's owner with the users
+// of this service it names as attendees, or moves one the owner organizes.
+// Both go through the same checks as book-slot and reschedule-slot, the
+// attendees of an existing booking are left as they are
+func caldavPutEvent(c *gin.Context) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	owner, ok := caldavUser(c, db)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxCalendarSize)
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	name := c.Param("name")
+	if !strings.HasSuffix(name, ".ics") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "resource name has to end with .ics",
+		})
+		return
+	}
+
+	loc, err := getUserLocation(db, owner)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get the organizer",
+		})
+		return
+	}
+	event, attendees, err := parseCalDAVEvent(db, string(data), loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// the check and the write share a transaction holding the write lock
+	tx, err := db.Begin()
+	if isDatabaseBusy(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "the calendar is busy, try again",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	existing, found, err := getCalDAVEvent(tx, owner, name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get booked slots",
+		})
+		return
+	}
+	ifMatch := c.GetHeader("If-Match")
+	if (found && c.GetHeader("If-None-Match") == "*") || (!found && ifMatch != "") || (found && ifMatch != "" && ifMatch != "*" && ifMatch != existing.etag()) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"status":  "error",
+			"message": "the event has changed",
+		})
+		return
+	}
+
+	users := []int{owner}
+	if found {
+		if existing.slot.OrganizerID != owner {
+			c.JSON(http.StatusForbidden, gin.H{
+				"status":  "error",
+				"message": "only the organizer can move the booking",
+			})
+			return
+		}
+		if existing.object.UID != event.UID {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "the UID of an event can't change",
+			})
+			return
+		}
+		attendees = existing.slot.Attendees
+	} else {
+		var id int
+		if err = tx.QueryRow(getCalDAVObjectByUID, event.UID).Scan(&id); err == nil || strings.HasSuffix(event.UID, "@calenderapi") {
+			c.JSON(http.StatusConflict, gin.H{
+				"status":  "error",
+				"message": "UID is already used by another event",
+			})
+			return
+		}
+	}
+	for _, attendee := range attendees {
+		if attendee != owner && !slices.Contains(users, attendee) {
+			users = append(users, attendee)
+		}
+	}
+
+	length := event.End.Sub(event.Start)
+	start := event.Start.In(loc)
+	date := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	config := slotConfig{DurationMinutes: int(length / time.Minute), Every: caldavSearchEvery}
+	input := slotInput{UserIDs: users, Date: date.Format("2006-01-02"), SlotConfig: config}
+	if _, err = input.participants(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if !event.Start.Truncate(time.Minute).Equal(event.Start) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "events have to start on a whole minute",
+		})
+		return
+	}
+	if _, err = config.minutes(); err != nil || length%time.Minute != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("duration has to be whole minutes between %d and %d", minSlotDuration, maxSlotDuration),
+		})
+		return
+	}
+
+	if found {
+		booked, err := existing.slot.timeRange()
+		if err == nil && booked.Start.Equal(event.Start) && booked.End.Equal(event.End) {
+			// nothing this service keeps has changed
+			c.Header("ETag", existing.etag())
+			c.Status(http.StatusNoContent)
+			return
+		}
+	}
+	if isPastDate(date) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "date cannot be in the past",
+		})
+		return
+	}
+
+	ignoreBooking := 0
+	if found {
+		ignoreBooking = existing.slot.ID
+	}
+	slot, code, user, err := checkBookableSlot(tx, input, users, date, formatTimestamp(start), ignoreBooking)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status":  "error",
+			"message": "unable to check the slot",
+		})
+		return
+	}
+	if code == dailyCapReached || code == weeklyCapReached {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"code":    code,
+			"message": fmt.Sprintf("user %d has no room left for another meeting", user),
+		})
+		return
+	}
+	if code != "" || !slot.Start.Equal(event.Start) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "slot unavailable",
+		})
+		return
+	}
+
+	id := int64(existing.slot.ID)
+	if found {
+		slotEnd := slot.End.Add(-time.Minute)
+		_, err = tx.Exec(rescheduleBookedSlot,
+			slot.Start.Format("2006-01-02"),
+			slot.Start.Hour(),
+			slot.Start.Minute(),
+			slotEnd.Hour(),
+			slotEnd.Minute(),
+			config.DurationMinutes,
+			formatTimestamp(slot.Start),
+			formatTimestamp(slot.End),
+			formatTimestamp(now()),
+			id,
+		)
+	} else {
+		id, err = insertBooking(tx, users, slot, config, nil)
+		if err == nil {
+			_, err = tx.Exec(insertCalDAVObject, id, event.UID, name)
+		}
+	}
+	if isBookingOverlap(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "slot unavailable",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to confirm the slot",
+		})
+		return
+	}
+	stored, _, err := getCalDAVEvent(tx, owner, name)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if isDatabaseBusy(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "the calendar is busy, try again",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to confirm the slot",
+		})
+		return
+	}
+
+	c.Header("ETag", stored.etag())
+	if found {
+		notifyBookingWebhooks(db, webhookBookingRescheduled, []int64{id}, gin.H{
+			"previous_starts_at": existing.slot.StartsAt,
+			"previous_ends_at":   existing.slot.EndsAt,
+		})
+		c.Status(http.StatusNoContent)
+		return
+	}
+	notifyBookingWebhooks(db, webhookBookingCreated, []int64{id}, nil)
+	mailBookings(db, "REQUEST", []int64{id})
+	c.Header("Location", caldavCollectionHref(owner)+name)
+	c.Status(http.StatusCreated)
+}
+
+// caldavDeleteEvent cancels a booking for all of its attendees, as
+// cancel-slot does. Only the organizer can cancel it, as only the organizer
+// can move it
+func caldavDeleteEvent(c *gin.Context) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	user, ok := caldavUser(c, db)
+	if !ok {
+		return
+	}
+
+	// the lookup and the cancellation run in one transaction so that the
+	// If-Match precondition holds until the booking is cancelled
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	event, found, err := getCalDAVEvent(tx, user, c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get booked slots",
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "error",
+			"message": "event not found",
+		})
+		return
+	}
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" && ifMatch != "*" && ifMatch != event.etag() {
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"status":  "error",
+			"message": "the event has changed",
+		})
+		return
+	}
+	if event.slot.OrganizerID != user {
+		c.JSON(http.StatusForbidden, gin.H{
+			"status":  "error",
+			"message": "only the organizer can cancel the booking",
+		})
+		return
+	}
+
+	reason := "cancelled over CalDAV"
+	res, err := tx.Exec(cancelBookedSlot, formatTimestamp(now()), reason, event.slot.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to cancel the slot",
+		})
+		return
+	}
+	if cancelled, err := res.RowsAffected(); err != nil || cancelled < 1 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "error",
+			"message": "event not found",
+		})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to cancel the slot",
+		})
+		return
+	}
+
+	notifyBookingWebhooks(db, webhookBookingCancelled, []int64{int64(event.slot.ID)}, gin.H{"reason": reason})
+	mailBookings(db, "CANCEL", []int64{int64(event.slot.ID)})
+	c.Status(http.StatusNoContent)
+}
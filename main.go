@@ -1,23 +1,47 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 // typedefs
 type availabilityStatus map[string]bool
-type availabilityInfo map[string]userAvailability
+type availabilityInfo map[string]timeRange
 
 var dayOfTheWeekMap = make(map[time.Weekday]string)
 
@@ -28,86 +52,586 @@ const (
 	hourly     slotDuration = "hourly"
 )
 
-var file string = fmt.Sprintf("%s?%s", "file:calendar.db", "_foreign_keys=on")
+// transactions take the write lock up front (BEGIN IMMEDIATE) so that an
+// availability check and the booking that follows it can't interleave with
+// another booking, concurrent writers wait for up to 5 seconds
+var file string = fmt.Sprintf("%s?%s", "file:calendar.db", "_foreign_keys=on&_txlock=immediate&_busy_timeout=5000")
 
+// named durations are kept for compatibility, duration_minutes takes any
+// length between minSlotDuration and maxSlotDuration
 var durationToInt = map[slotDuration]int{
 	halfHourly: 30,
 	hourly:     60,
 }
 
+// maxParticipants caps the users of a single meeting
+const maxParticipants = 10
+
+// maxSearchDays caps a date range search, it is also how far ahead the next
+// available slots are looked up. maxNextSlots caps the number of those
+const maxSearchDays = 31
+const maxNextSlots = 100
+
+// errNoAvailability is returned when a user has no availability at all on a
+// date, a range search skips such dates
+var errNoAvailability = errors.New("no availability set")
+
+// errInvalidTimeZone is returned for a time_zone that isn't an IANA name
+var errInvalidTimeZone = errors.New("invalid time zone")
+
+// bounds on the meeting length in minutes, overridden through the
+// MIN_SLOT_DURATION_MINUTES and MAX_SLOT_DURATION_MINUTES environment variables
+var minSlotDuration = 15
+var maxSlotDuration = 240
+
+// maxCalendarSize caps an uploaded iCalendar file, in bytes
+const maxCalendarSize = 5 << 20
+
+// calendarImportDir, set through the ICS_IMPORT_DIR environment variable, is
+// the only directory external calendars can be read from, none can when it
+// is not set
+var calendarImportDir = ""
+
+// maxBufferMinutes caps the buffer a user keeps before and after meetings
+const maxBufferMinutes = 120
+
+// bounds on the minimum notice (in minutes) and the rolling horizon (in days)
+// a user can ask for
+const maxNoticeMinutes = 30 * 24 * 60
+const maxHorizonDays = 365
+
+// now is the clock the booking rules are checked against, a variable so that
+// it can be swapped for a fixed clock
+var now = time.Now
+
 // SQL statements DDL, DML
 const userCreate string = `
 CREATE TABLE IF NOT EXISTS calendar_user (
 	id INTEGER NOT NULL PRIMARY KEY,
 	name VARCHAR(20) NOT NULL,
+	email TEXT NOT NULL DEFAULT '',
+	time_zone TEXT NOT NULL DEFAULT 'UTC',
+	buffer_before_minutes INTEGER NOT NULL DEFAULT 0 CHECK (buffer_before_minutes >= 0),
+	buffer_after_minutes INTEGER NOT NULL DEFAULT 0 CHECK (buffer_after_minutes >= 0),
+	min_notice_minutes INTEGER NOT NULL DEFAULT 0 CHECK (min_notice_minutes >= 0),
+	max_horizon_days INTEGER NOT NULL DEFAULT 0 CHECK (max_horizon_days >= 0),
+	max_meetings_per_day INTEGER NOT NULL DEFAULT 0 CHECK (max_meetings_per_day >= 0),
+	max_minutes_per_day INTEGER NOT NULL DEFAULT 0 CHECK (max_minutes_per_day >= 0),
+	max_meetings_per_week INTEGER NOT NULL DEFAULT 0 CHECK (max_meetings_per_week >= 0),
+	max_minutes_per_week INTEGER NOT NULL DEFAULT 0 CHECK (max_minutes_per_week >= 0),
+	caldav_password TEXT NOT NULL DEFAULT '',
 	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 `
 
 const availabilityCreate string = `
 CREATE TABLE IF NOT EXISTS calendar_user_availability (
-  user_id INTEGER NOT NULL,
+	id INTEGER NOT NULL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
 	day TEXT CHECK (day IN ('monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday')) NOT NULL,
 	start_time_hour INTEGER CHECK (start_time_hour > 0 AND start_time_hour < 24) NOT NULL,
 	start_time_minutes INTEGER CHECK (start_time_minutes >= 0 AND start_time_minutes < 60) NOT NULL,
 	end_time_hour INTEGER CHECK (end_time_hour >= 0 AND end_time_hour < 24) NOT NULL,
 	end_time_minutes INTEGER CHECK (end_time_minutes >= 0 AND end_time_minutes < 60) NOT NULL,
 	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-	PRIMARY KEY (user_id, day),
 	FOREIGN KEY (user_id) REFERENCES calendar_user(id)
 )`
 
+const availabilityIndexCreate string = `
+CREATE INDEX IF NOT EXISTS calendar_user_availability_user_day ON calendar_user_availability (user_id, day);`
+
+// availability rules repeat windows following an RRULE (see recurrenceRule)
+// from start_date, until end_date when set. They add up with the weekly
+// windows of calendar_user_availability, getUserAvailability merges both
+// for a date
+const availabilityRuleCreate string = `
+CREATE TABLE IF NOT EXISTS calendar_user_availability_rule (
+	id INTEGER NOT NULL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	recurrence TEXT NOT NULL,
+	start_date DATE NOT NULL,
+	end_date DATE,
+	start_time_hour INTEGER CHECK (start_time_hour > 0 AND start_time_hour < 24) NOT NULL,
+	start_time_minutes INTEGER CHECK (start_time_minutes >= 0 AND start_time_minutes < 60) NOT NULL,
+	end_time_hour INTEGER CHECK (end_time_hour >= 0 AND end_time_hour < 24) NOT NULL,
+	end_time_minutes INTEGER CHECK (end_time_minutes >= 0 AND end_time_minutes < 60) NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	CHECK (end_date IS NULL OR end_date >= start_date),
+	FOREIGN KEY (user_id) REFERENCES calendar_user(id)
+)`
+
+const availabilityRuleIndexCreate string = `
+CREATE INDEX IF NOT EXISTS calendar_user_availability_rule_user ON calendar_user_availability_rule (user_id, start_date);`
+
+// availability overrides win over the weekly pattern for every date between
+// start_date and end_date, a row with available = 0 marks time off
+const availabilityOverrideCreate string = `
+CREATE TABLE IF NOT EXISTS calendar_user_availability_override (
+	id INTEGER NOT NULL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	start_date DATE NOT NULL,
+	end_date DATE NOT NULL,
+	available BOOLEAN NOT NULL,
+	start_time_hour INTEGER CHECK (start_time_hour > 0 AND start_time_hour < 24),
+	start_time_minutes INTEGER CHECK (start_time_minutes >= 0 AND start_time_minutes < 60),
+	end_time_hour INTEGER CHECK (end_time_hour >= 0 AND end_time_hour < 24),
+	end_time_minutes INTEGER CHECK (end_time_minutes >= 0 AND end_time_minutes < 60),
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	CHECK (end_date >= start_date),
+	CHECK (available = 0 OR (start_time_hour IS NOT NULL AND start_time_minutes IS NOT NULL AND end_time_hour IS NOT NULL AND end_time_minutes IS NOT NULL)),
+	FOREIGN KEY (user_id) REFERENCES calendar_user(id)
+)`
+
+const availabilityOverrideIndexCreate string = `
+CREATE INDEX IF NOT EXISTS calendar_user_availability_override_user_dates ON calendar_user_availability_override (user_id, start_date, end_date);`
+
+// a booked slot is one meeting, organized by the user whose time zone date
+// and the hour/minute fields are in, every participant (organizer included)
+// is listed in calendar_user_booked_slot_attendees
 const bookedSlots string = `
 CREATE TABLE IF NOT EXISTS calendar_user_booked_slots (
 	id INTEGER NOT NULL PRIMARY KEY,
-  user_id_1 INTEGER NOT NULL,
-  user_id_2 INTEGER NOT NULL,
+	organizer_id INTEGER NOT NULL,
 	date DATE NOT NULL,
-	start_time_hour INTEGER CHECK (start_time_hour > 0 AND start_time_hour < 24) NOT NULL,
+	start_time_hour INTEGER CHECK (start_time_hour >= 0 AND start_time_hour < 24) NOT NULL,
 	start_time_minutes INTEGER CHECK (start_time_minutes >= 0 AND start_time_minutes < 60) NOT NULL,
 	end_time_hour INTEGER CHECK (end_time_hour >= 0 AND end_time_hour < 24) NOT NULL,
 	end_time_minutes INTEGER CHECK (end_time_minutes >= 0 AND end_time_minutes < 60) NOT NULL,
-	slot_type TEXT CHECK (slot_type IN ('hourly', 'half-hourly')) NOT NULL,
+	duration_minutes INTEGER CHECK (duration_minutes > 0) NOT NULL,
+	starts_at TEXT NOT NULL,
+	ends_at TEXT NOT NULL,
+	cancelled_at TEXT,
+	cancellation_reason TEXT,
+	series_id INTEGER,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at TEXT,
+
+	FOREIGN KEY (organizer_id) REFERENCES calendar_user(id),
+	FOREIGN KEY (series_id) REFERENCES calendar_user_booking_series(id)
+)`
+
+// external calendars are iCalendar files whose events count as busy time for
+// the user, either uploaded (content) or read from a local path on every
+// lookup so that changes to the file are picked up
+const externalCalendarCreate string = `
+CREATE TABLE IF NOT EXISTS calendar_user_external_calendar (
+	id INTEGER NOT NULL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	path TEXT,
+	content TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	CHECK ((path IS NULL) != (content IS NULL)),
+	FOREIGN KEY (user_id) REFERENCES calendar_user(id)
+)`
+
+const externalCalendarIndexCreate string = `
+CREATE INDEX IF NOT EXISTS calendar_user_external_calendar_user ON calendar_user_external_calendar (user_id);`
+
+// reminders sent, or skipped, for a booking at a given start time
+const bookingReminderCreate string = `
+CREATE TABLE IF NOT EXISTS calendar_user_booking_reminder (
+	booked_slot_id INTEGER NOT NULL,
+	starts_at DATETIME NOT NULL,
+	offset_minutes INTEGER NOT NULL,
+	skipped BOOLEAN NOT NULL DEFAULT 0,
+	sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (booked_slot_id, starts_at, offset_minutes),
+	FOREIGN KEY (booked_slot_id) REFERENCES calendar_user_booked_slots(id)
+)`
+
+// webhooks get a signed POST for every event they subscribe to, all of them
+// when events is empty
+const webhookCreate string = `
+CREATE TABLE IF NOT EXISTS calendar_webhook (
+	id INTEGER NOT NULL PRIMARY KEY,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`
+
+// every delivery attempt of a webhook is logged
+const webhookDeliveryCreate string = `
+CREATE TABLE IF NOT EXISTS calendar_webhook_delivery (
+	id INTEGER NOT NULL PRIMARY KEY,
+	webhook_id INTEGER NOT NULL,
+	event_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (webhook_id) REFERENCES calendar_webhook(id)
+)`
+
+const webhookDeliveryIndexCreate string = `
+CREATE INDEX IF NOT EXISTS calendar_webhook_delivery_webhook ON calendar_webhook_delivery (webhook_id, id);`
+
+// a booking series groups the occurrences of a recurring booking, each of
+// them being a booked slot of its own
+const bookingSeries string = `
+CREATE TABLE IF NOT EXISTS calendar_user_booking_series (
+	id INTEGER NOT NULL PRIMARY KEY,
+	organizer_id INTEGER NOT NULL,
+	recurrence TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+	FOREIGN KEY (organizer_id) REFERENCES calendar_user(id)
+)`
+
+const bookedSlotsIndexCreate string = `
+CREATE INDEX IF NOT EXISTS calendar_user_booked_slots_starts_at ON calendar_user_booked_slots (starts_at, ends_at);`
+
+const bookedSlotAttendees string = `
+CREATE TABLE IF NOT EXISTS calendar_user_booked_slot_attendees (
+	booked_slot_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
 	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (booked_slot_id, user_id),
+	FOREIGN KEY (booked_slot_id) REFERENCES calendar_user_booked_slots(id),
+	FOREIGN KEY (user_id) REFERENCES calendar_user(id)
+)`
 
-	FOREIGN KEY (user_id_1) REFERENCES calendar_user(id),
-	FOREIGN KEY (user_id_2) REFERENCES calendar_user(id)
+const bookedSlotAttendeesIndexCreate string = `
+CREATE INDEX IF NOT EXISTS calendar_user_booked_slot_attendees_user ON calendar_user_booked_slot_attendees (user_id);`
+
+// bookings created over CalDAV keep the UID and resource name the client
+// picked, other bookings are served as booking-<id>.ics
+const caldavObjectCreate string = `
+CREATE TABLE IF NOT EXISTS calendar_user_caldav_object (
+	booked_slot_id INTEGER NOT NULL PRIMARY KEY,
+	uid TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL UNIQUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (booked_slot_id) REFERENCES calendar_user_booked_slots(id)
 )`
 
+// bookings of a user never overlap, enforced in the database as well so
+// that no code path can double book
+const bookedSlotsNoOverlapInsert string = `
+CREATE TRIGGER IF NOT EXISTS calendar_user_booked_slot_attendees_no_overlap_insert
+BEFORE INSERT ON calendar_user_booked_slot_attendees
+BEGIN
+	SELECT RAISE(ABORT, 'slot overlaps an existing booking')
+	WHERE EXISTS (
+		SELECT 1 FROM calendar_user_booked_slot_attendees attendee
+		JOIN calendar_user_booked_slots booked ON booked.id = attendee.booked_slot_id
+		JOIN calendar_user_booked_slots new ON new.id = NEW.booked_slot_id
+		WHERE attendee.user_id = NEW.user_id AND booked.id != new.id
+		AND booked.cancelled_at IS NULL AND new.cancelled_at IS NULL
+		AND booked.starts_at < new.ends_at AND booked.ends_at > new.starts_at
+	);
+END;`
+
+const bookedSlotsNoOverlapUpdate string = `
+CREATE TRIGGER IF NOT EXISTS calendar_user_booked_slots_no_overlap_update
+BEFORE UPDATE OF starts_at, ends_at ON calendar_user_booked_slots
+WHEN NEW.cancelled_at IS NULL
+BEGIN
+	SELECT RAISE(ABORT, 'slot overlaps an existing booking')
+	WHERE EXISTS (
+		SELECT 1 FROM calendar_user_booked_slot_attendees mine
+		JOIN calendar_user_booked_slot_attendees other ON other.user_id = mine.user_id AND other.booked_slot_id != mine.booked_slot_id
+		JOIN calendar_user_booked_slots booked ON booked.id = other.booked_slot_id
+		WHERE mine.booked_slot_id = NEW.id AND booked.cancelled_at IS NULL
+		AND booked.starts_at < NEW.ends_at AND booked.ends_at > NEW.starts_at
+	);
+END;`
+
 const insertUser string = `
-INSERT INTO calendar_user (name) VALUES (?);
+INSERT INTO calendar_user (name, email, time_zone) VALUES (?, ?, ?);
 `
 
+const getUserName string = `
+SELECT name FROM calendar_user WHERE id=?;`
+
+const getUserTimeZone string = `
+SELECT time_zone FROM calendar_user WHERE id=?;`
+
+const getUserContact string = `
+SELECT name, email, time_zone FROM calendar_user WHERE id=?;`
+
+const getUserByEmail string = `
+SELECT id FROM calendar_user WHERE email=? COLLATE NOCASE ORDER BY id LIMIT 1;`
+
+const getUserCalDAVPassword string = `
+SELECT caldav_password FROM calendar_user WHERE id=?;`
+
+const updateUserCalDAVPassword string = `
+UPDATE calendar_user SET caldav_password=? WHERE id=?;`
+
+const updateUserEmail string = `
+UPDATE calendar_user SET email=? WHERE id=?;`
+
+const updateUserTimeZone string = `
+UPDATE calendar_user SET time_zone=? WHERE id=?;`
+
+// a max_horizon_days of 0 leaves the horizon open
+const getUserBookingRules string = `
+SELECT buffer_before_minutes, buffer_after_minutes, min_notice_minutes, max_horizon_days FROM calendar_user WHERE id=?;`
+
+const updateUserNotice string = `
+UPDATE calendar_user SET min_notice_minutes=?, max_horizon_days=? WHERE id=?;`
+
+// caps of 0 leave the number of meetings, or minutes, unlimited
+const getUserMeetingCaps string = `
+SELECT max_meetings_per_day, max_minutes_per_day, max_meetings_per_week, max_minutes_per_week FROM calendar_user WHERE id=?;`
+
+const updateUserMeetingCaps string = `
+UPDATE calendar_user SET max_meetings_per_day=?, max_minutes_per_day=?, max_meetings_per_week=?, max_minutes_per_week=? WHERE id=?;`
+
+// meetings of a user starting between two timestamps, a meeting counts
+// towards the day (and week) it starts on
+const getUserBookedLoad string = `
+SELECT COUNT(*), COALESCE(SUM(duration_minutes), 0) FROM calendar_user_booked_slots WHERE id IN (SELECT booked_slot_id FROM calendar_user_booked_slot_attendees WHERE user_id=?) AND starts_at>=? AND starts_at<? AND cancelled_at IS NULL AND id!=?;`
+
+const updateUserBuffer string = `
+UPDATE calendar_user SET buffer_before_minutes=?, buffer_after_minutes=? WHERE id=?;`
+
 const insertAvailability string = `
 INSERT INTO calendar_user_availability (user_id, day, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes) VALUES (?, ?, ?, ?, ?, ?);`
 
 const getUserAvailabilitySetting string = `
-SELECT user_id, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes FROM calendar_user_availability WHERE user_id=? AND day=?;`
+SELECT user_id, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes FROM calendar_user_availability WHERE user_id=? AND day=? ORDER BY start_time_hour, start_time_minutes;`
 
+// booked slots are matched on starts_at/ends_at, RFC 3339 timestamps in UTC
+// which sort lexicographically. Cancelled slots are kept for history but
+// never block a slot. Every booked slot query returns the same columns, read
+// with scanScheduledSlot, attendees being a comma separated list of user ids
+// and the last column the time the booking last changed
 const getUserBookedSlots string = `
-SELECT user_id_1, user_id_2, date, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, slot_type  FROM calendar_user_booked_slots WHERE (user_id_1=? OR user_id_1=?) AND (user_id_2=? OR user_id_2=?) AND date=?;`
+SELECT id, organizer_id, (SELECT GROUP_CONCAT(user_id) FROM calendar_user_booked_slot_attendees WHERE booked_slot_id=id), date(date), start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, duration_minutes, starts_at, ends_at, series_id, cancelled_at, COALESCE(cancelled_at, updated_at, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)) FROM calendar_user_booked_slots WHERE id IN (SELECT booked_slot_id FROM calendar_user_booked_slot_attendees WHERE user_id=?) AND starts_at<? AND ends_at>? AND cancelled_at IS NULL AND id!=?;`
+
+const getBookedSlot string = `
+SELECT id, organizer_id, (SELECT GROUP_CONCAT(user_id) FROM calendar_user_booked_slot_attendees WHERE booked_slot_id=id), date(date), start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, duration_minutes, starts_at, ends_at, series_id, cancelled_at, COALESCE(cancelled_at, updated_at, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)) FROM calendar_user_booked_slots WHERE id=? AND cancelled_at IS NULL;`
+
+const rescheduleBookedSlot string = `
+UPDATE calendar_user_booked_slots SET date=?, start_time_hour=?, start_time_minutes=?, end_time_hour=?, end_time_minutes=?, duration_minutes=?, starts_at=?, ends_at=?, updated_at=? WHERE id=? AND cancelled_at IS NULL;`
+
+const cancelBookedSlot string = `
+UPDATE calendar_user_booked_slots SET cancelled_at=?, cancellation_reason=? WHERE id=? AND cancelled_at IS NULL;`
+
+// occurrences that already started are left as they are
+const cancelBookingSeries string = `
+UPDATE calendar_user_booked_slots SET cancelled_at=?, cancellation_reason=? WHERE series_id=? AND starts_at>=? AND cancelled_at IS NULL RETURNING id;`
+
+// a booking whether or not it's cancelled, for notifications
+const getBookedSlotWithCancelled string = `
+SELECT id, organizer_id, (SELECT GROUP_CONCAT(user_id) FROM calendar_user_booked_slot_attendees WHERE booked_slot_id=id), date(date), start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, duration_minutes, starts_at, ends_at, series_id, cancelled_at, COALESCE(cancelled_at, updated_at, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)) FROM calendar_user_booked_slots WHERE id=?;`
+
+const deleteUserAvailability string = `
+DELETE FROM calendar_user_availability WHERE user_id=? AND day=?;`
+
+// every booking of a user, cancelled ones included, for calendar feeds
+const getUserAllBookedSlots string = `
+SELECT id, organizer_id, (SELECT GROUP_CONCAT(user_id) FROM calendar_user_booked_slot_attendees WHERE booked_slot_id=id), date(date), start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, duration_minutes, starts_at, ends_at, series_id, cancelled_at, COALESCE(cancelled_at, updated_at, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)) FROM calendar_user_booked_slots WHERE id IN (SELECT booked_slot_id FROM calendar_user_booked_slot_attendees WHERE user_id=?) ORDER BY starts_at;`
+
+const getUserUpcomingBookedSlots string = `
+SELECT id, organizer_id, (SELECT GROUP_CONCAT(user_id) FROM calendar_user_booked_slot_attendees WHERE booked_slot_id=id), date(date), start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, duration_minutes, starts_at, ends_at, series_id, cancelled_at, COALESCE(cancelled_at, updated_at, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)) FROM calendar_user_booked_slots WHERE id IN (SELECT booked_slot_id FROM calendar_user_booked_slot_attendees WHERE user_id=?) AND ends_at>? AND cancelled_at IS NULL ORDER BY starts_at;`
+
+const insertCalDAVObject string = `
+INSERT INTO calendar_user_caldav_object (booked_slot_id, uid, name) VALUES (?, ?, ?);`
+
+const getCalDAVObjectByName string = `
+SELECT booked_slot_id FROM calendar_user_caldav_object WHERE name=?;`
+
+const getCalDAVObjectByUID string = `
+SELECT booked_slot_id FROM calendar_user_caldav_object WHERE uid=?;`
+
+const getUserCalDAVObjects string = `
+SELECT booked_slot_id, uid, name FROM calendar_user_caldav_object WHERE booked_slot_id IN (SELECT booked_slot_id FROM calendar_user_booked_slot_attendees WHERE user_id=?);`
+
+// bookings of every user starting after the first time and up to the second
+const getUpcomingBookedSlots string = `
+SELECT id, organizer_id, (SELECT GROUP_CONCAT(user_id) FROM calendar_user_booked_slot_attendees WHERE booked_slot_id=id), date(date), start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, duration_minutes, starts_at, ends_at, series_id, cancelled_at, COALESCE(cancelled_at, updated_at, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)) FROM calendar_user_booked_slots WHERE starts_at>? AND starts_at<=? AND cancelled_at IS NULL ORDER BY starts_at;`
+
+const insertBookingReminder string = `
+INSERT OR IGNORE INTO calendar_user_booking_reminder (booked_slot_id, starts_at, offset_minutes, skipped) VALUES (?, ?, ?, ?);`
+
+const insertWebhook string = `
+INSERT INTO calendar_webhook (url, secret, events) VALUES (?, ?, ?);`
+
+const deleteWebhookDeliveries string = `
+DELETE FROM calendar_webhook_delivery WHERE webhook_id=?;`
+
+const deleteCalendarWebhook string = `
+DELETE FROM calendar_webhook WHERE id=?;`
+
+const getWebhooks string = `
+SELECT id, url, secret, events FROM calendar_webhook;`
+
+const insertWebhookDelivery string = `
+INSERT INTO calendar_webhook_delivery (webhook_id, event_id, event, payload, attempt, status_code, error) VALUES (?, ?, ?, ?, ?, ?, ?);`
+
+// the latest attempts come first
+const getWebhookDeliveries string = `
+SELECT id, event_id, event, payload, attempt, status_code, error, created_at FROM calendar_webhook_delivery WHERE webhook_id=? ORDER BY id DESC LIMIT 100;`
 
-const getSingleUserBookedSlots string = `
-SELECT user_id_1, user_id_2, date, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, slot_type  FROM calendar_user_booked_slots WHERE (user_id_1=? OR user_id_2=?) AND date=?;`
+const insertExternalCalendar string = `
+INSERT INTO calendar_user_external_calendar (user_id, path, content) VALUES (?, ?, ?);`
+
+const deleteUserExternalCalendar string = `
+DELETE FROM calendar_user_external_calendar WHERE id=? AND user_id=?;`
+
+const getUserExternalCalendars string = `
+SELECT id, path, content FROM calendar_user_external_calendar WHERE user_id=?;`
+
+const insertAvailabilityRule string = `
+INSERT INTO calendar_user_availability_rule (user_id, recurrence, start_date, end_date, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+
+const deleteUserAvailabilityRule string = `
+DELETE FROM calendar_user_availability_rule WHERE id=? AND user_id=?;`
+
+// rules that may cover a date, the recurrence decides whether they do
+const getUserAvailabilityRules string = `
+SELECT user_id, recurrence, date(start_date), start_time_hour, start_time_minutes, end_time_hour, end_time_minutes FROM calendar_user_availability_rule WHERE user_id=? AND start_date<=? AND (end_date IS NULL OR end_date>=?);`
+
+const insertAvailabilityOverride string = `
+INSERT INTO calendar_user_availability_override (user_id, start_date, end_date, available, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+
+const deleteAvailabilityOverrideRow string = `
+DELETE FROM calendar_user_availability_override WHERE id=?;`
+
+// the most recent override comes first
+const getUserAvailabilityOverrides string = `
+SELECT id, user_id, date(start_date), date(end_date), available, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes FROM calendar_user_availability_override WHERE user_id=? AND start_date<=? AND end_date>=? ORDER BY id DESC;`
 
 const insertSlot string = `
-INSERT INTO calendar_user_booked_slots (user_id_1, user_id_2, date, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, slot_type) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+INSERT INTO calendar_user_booked_slots (organizer_id, date, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, duration_minutes, starts_at, ends_at, series_id, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+const insertBookingSeries string = `
+INSERT INTO calendar_user_booking_series (organizer_id, recurrence) VALUES (?, ?);`
+
+const insertSlotAttendee string = `
+INSERT INTO calendar_user_booked_slot_attendees (booked_slot_id, user_id) VALUES (?, ?);`
 
 type server struct {
-	mu sync.Mutex
 	db *sql.DB
 }
 
+// querier is satisfied by both *sql.DB and *sql.Tx so that lookups can run
+// inside a transaction
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// timeRange is a half open interval [Start, End) in absolute time
+type timeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// overlaps reports whether r and other share any instant
+func (r timeRange) overlaps(other timeRange) bool {
+	return r.Start.Before(other.End) && other.Start.Before(r.End)
+}
+
+// pad widens r by before and after
+func (r timeRange) pad(before time.Duration, after time.Duration) timeRange {
+	return timeRange{Start: r.Start.Add(-before), End: r.End.Add(after)}
+}
+
+// within reports whether r is fully covered by windows, which have to be
+// sorted and free of overlaps
+func (r timeRange) within(windows []timeRange) bool {
+	var covered time.Duration
+	for _, part := range intersectTimeRanges([]timeRange{r}, windows) {
+		covered += part.End.Sub(part.Start)
+	}
+	return covered == r.End.Sub(r.Start)
+}
+
+// mergeTimeRanges clips ranges to window and merges the ones overlapping or
+// touching each other, the result is sorted
+func mergeTimeRanges(ranges []timeRange, window timeRange) []timeRange {
+	var clipped []timeRange
+	for _, r := range ranges {
+		if r.Start.Before(window.Start) {
+			r.Start = window.Start
+		}
+		if r.End.After(window.End) {
+			r.End = window.End
+		}
+		if r.Start.Before(r.End) {
+			clipped = append(clipped, r)
+		}
+	}
+	sort.Slice(clipped, func(i, j int) bool {
+		return clipped[i].Start.Before(clipped[j].Start)
+	})
+
+	merged := []timeRange{}
+	for _, r := range clipped {
+		if last := len(merged) - 1; last >= 0 && !r.Start.After(merged[last].End) {
+			if r.End.After(merged[last].End) {
+				merged[last].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
 // data structures to capture business data
+
+// scheduledSlot is a booked slot, the date and hour/minute fields are in the
+// time zone of the organizer while starts_at/ends_at are absolute
 type scheduledSlot struct {
-	UserID1          int          `json:"user_id_1"`
-	UserID2          int          `json:"user_id_2"`
-	Date             string       `json:"date"`
-	StartTimeHour    int          `json:"start_time_hour"`
-	StartTimeMinutes int          `json:"start_time_minutes"`
-	EndTimeHour      int          `json:"end_time_hour"`
-	EndTimeMinutes   int          `json:"end_time_minutes"`
-	SlotDuration     slotDuration `json:"slot_duration"`
+	ID               int    `json:"id"`
+	OrganizerID      int    `json:"organizer_id"`
+	Attendees        []int  `json:"attendees"`
+	Date             string `json:"date"`
+	StartTimeHour    int    `json:"start_time_hour"`
+	StartTimeMinutes int    `json:"start_time_minutes"`
+	EndTimeHour      int    `json:"end_time_hour"`
+	EndTimeMinutes   int    `json:"end_time_minutes"`
+	DurationMinutes  int    `json:"duration_minutes"`
+	StartsAt         string `json:"starts_at"`
+	EndsAt           string `json:"ends_at"`
+	SeriesID         int    `json:"series_id,omitempty"`
+	CancelledAt      string `json:"cancelled_at,omitempty"`
+
+	// the last time the booking was made, rescheduled or cancelled
+	updatedAt string
+}
+
+// timeRange parses the absolute starts_at/ends_at of a booked slot
+func (slot scheduledSlot) timeRange() (timeRange, error) {
+	start, err := time.Parse(time.RFC3339, slot.StartsAt)
+	if err != nil {
+		return timeRange{}, err
+	}
+	end, err := time.Parse(time.RFC3339, slot.EndsAt)
+	if err != nil {
+		return timeRange{}, err
+	}
+	return timeRange{Start: start, End: end}, nil
+}
+
+// scanScheduledSlot reads a row of any of the booked slot queries
+func scanScheduledSlot(row interface{ Scan(...any) error }) (scheduledSlot, error) {
+	var slot scheduledSlot
+	var attendees sql.NullString
+	var seriesID sql.NullInt64
+	var cancelledAt, updatedAt sql.NullString
+	if err := row.Scan(&slot.ID, &slot.OrganizerID, &attendees, &slot.Date, &slot.StartTimeHour, &slot.StartTimeMinutes, &slot.EndTimeHour, &slot.EndTimeMinutes, &slot.DurationMinutes, &slot.StartsAt, &slot.EndsAt, &seriesID, &cancelledAt, &updatedAt); err != nil {
+		return slot, err
+	}
+	slot.SeriesID = int(seriesID.Int64)
+	slot.CancelledAt = cancelledAt.String
+	slot.updatedAt = updatedAt.String
+	slot.Attendees = []int{}
+	for _, attendee := range strings.Split(attendees.String, ",") {
+		if user, err := strconv.Atoi(attendee); err == nil {
+			slot.Attendees = append(slot.Attendees, user)
+		}
+	}
+	sort.Ints(slot.Attendees)
+	return slot, nil
 }
 
 type userSlot struct {
@@ -127,32 +651,213 @@ type userAvailability struct {
 	EndTimeMinutes   int `json:"end_time_minutes"`
 }
 
+// slotInput looks up slots on a date where every user is free. user_ids wins
+// over the user_id_1/user_id_2 pair, date and slot are in time_zone, the
+// caller's own, which defaults to the time zone of the first user
 type slotInput struct {
 	UserID1    int        `json:"user_id_1"`
 	UserID2    int        `json:"user_id_2"`
+	UserIDs    []int      `json:"user_ids"`
 	Date       string     `json:"date"`
+	TimeZone   string     `json:"time_zone"`
 	SlotConfig slotConfig `json:"slot_lookup_config"`
 }
 
-// TOdo: date is < current date
+// participants lists the users of a slot lookup, the first one being the
+// organizer
+func (input slotInput) participants() ([]int, error) {
+	users := input.UserIDs
+	if len(users) == 0 {
+		users = []int{input.UserID1, input.UserID2}
+	}
+	if len(users) < 2 || len(users) > maxParticipants {
+		return nil, fmt.Errorf("a slot needs between 2 and %d users", maxParticipants)
+	}
+	seen := make(map[int]bool)
+	for _, user := range users {
+		if seen[user] {
+			return nil, errors.New("a user cannot be listed more than once")
+		}
+		seen[user] = true
+	}
+	return users, nil
+}
+
+// freeBusyInput looks up when users are busy between two RFC 3339 timestamps,
+// as JSON or, with format "ics", as iCalendar VFREEBUSY components
+type freeBusyInput struct {
+	UserIDs []int  `json:"user_ids"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Format  string `json:"format"`
+}
+
+// webhookInput registers url for events, every event when it's empty. The
+// secret signing deliveries is generated unless given
+type webhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+type deleteWebhookInput struct {
+	WebhookID int `json:"webhook_id"`
+}
+
+// webhookDelivery is an attempt to deliver an event to a webhook
+type webhookDelivery struct {
+	ID         int             `json:"id"`
+	EventID    string          `json:"event_id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempt    int             `json:"attempt"`
+	StatusCode int             `json:"status_code"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  string          `json:"created_at"`
+}
+
+// viewScheduleInput reads date, and shows the schedule, in time_zone, which
+// defaults to the user's own
 type viewScheduleInput struct {
-	UserID int    `json:"user_id"`
-	Date   string `json:"date"`
+	UserID       int    `json:"user_id"`
+	Date         string `json:"date"`
+	TimeZone     string `json:"time_zone"`
+	LegacyFormat bool   `json:"legacy_format"`
 }
 
+// findAvailableSlotInput can list optional attendees on top of the required
+// users, a slot is returned only when at least quorum of them are free.
+// Instead of a single date, slots can be looked up between from and to
+// (inclusive) or as the next N available slots starting from now
 type findAvailableSlotInput struct {
 	slotInput
+	OptionalUserIDs []int  `json:"optional_user_ids"`
+	Quorum          int    `json:"quorum"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Next            int    `json:"next"`
+	LegacyFormat    bool   `json:"legacy_format"`
+}
+
+// slotView is a slot as returned by the API, start and end are wall clock
+// times in the time zone of the response while timestamp is the ISO-8601
+// start time including its offset. optional_available lists the optional
+// attendees free at the slot, id is set on booked slots
+type slotView struct {
+	ID                int    `json:"id,omitempty"`
+	Start             string `json:"start"`
+	End               string `json:"end"`
+	DurationMinutes   int    `json:"duration_minutes"`
+	Timestamp         string `json:"timestamp"`
+	OptionalAvailable []int  `json:"optional_available,omitempty"`
+
+	at time.Time
+}
+
+func newSlotView(r timeRange, loc *time.Location) slotView {
+	return slotView{
+		Start:           r.Start.In(loc).Format("15:04"),
+		End:             r.End.In(loc).Format("15:04"),
+		DurationMinutes: int(r.End.Sub(r.Start) / time.Minute),
+		Timestamp:       r.Start.In(loc).Format(time.RFC3339),
+		at:              r.Start,
+	}
+}
+
+// sortSlotViews orders slots chronologically
+func sortSlotViews(slots []slotView) {
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].at.Before(slots[j].at)
+	})
+}
+
+// legacySlots turns slots back into the former "HH:MM" strings, along with
+// the optional attendees free at each of them
+func legacySlots(slots []slotView) ([]string, map[string][]int) {
+	keys := []string{}
+	optionalAvailable := make(map[string][]int)
+	for _, slot := range slots {
+		keys = append(keys, slot.Start)
+		optionalAvailable[slot.Start] = slot.OptionalAvailable
+	}
+	return keys, optionalAvailable
+}
+
+// dateSlots are the available slots of a single date
+type dateSlots struct {
+	Date  string     `json:"date"`
+	Slots []slotView `json:"slots"`
+}
+
+// optionalAttendees validates the optional attendees against the required
+// users and the quorum
+func (input findAvailableSlotInput) optionalAttendees(users []int) ([]int, error) {
+	if len(input.OptionalUserIDs) > maxParticipants {
+		return nil, fmt.Errorf("a slot cannot have more than %d optional users", maxParticipants)
+	}
+	seen := make(map[int]bool)
+	for _, user := range users {
+		seen[user] = true
+	}
+	for _, user := range input.OptionalUserIDs {
+		if seen[user] {
+			return nil, errors.New("a user cannot be listed more than once")
+		}
+		seen[user] = true
+	}
+	if input.Quorum < 0 || input.Quorum > len(input.OptionalUserIDs) {
+		return nil, errors.New("quorum has to be between 0 and the number of optional users")
+	}
+	return input.OptionalUserIDs, nil
 }
 
-// Check the available virtual slots that can be claimed on both the users
+// Check the available virtual slots that can be claimed on all the users
+// recurrence, when set, books the slot on every occurrence of an RRULE
+// starting on date, e.g. FREQ=WEEKLY;INTERVAL=2;COUNT=6
 type bookSlotInput struct {
-	Slot string `json:"slot"`
+	Slot       string `json:"slot"`
+	Recurrence string `json:"recurrence"`
 	slotInput
 }
 
 type slotConfig struct {
-	SlotDuration slotDuration `json:"slot_duration"`
-	Every        int          `json:"search_every"` // TODO: validate it to be > 20 and <= 60
+	SlotDuration    slotDuration `json:"slot_duration"`    // hourly, half-hourly
+	DurationMinutes int          `json:"duration_minutes"` // wins over slot_duration
+	Every           int          `json:"search_every"`     // TODO: validate it to be > 20 and <= 60
+}
+
+// minutes resolves the requested meeting length and checks it against the
+// configured bounds
+func (config slotConfig) minutes() (int, error) {
+	duration := config.DurationMinutes
+	if duration == 0 {
+		var ok bool
+		if duration, ok = durationToInt[config.SlotDuration]; !ok {
+			return 0, errors.New("unsupported duration, kindly set duration_minutes or slot_duration to hourly or half-hourly")
+		}
+	}
+	if duration < minSlotDuration || duration > maxSlotDuration {
+		return 0, fmt.Errorf("duration has to be between %d and %d minutes", minSlotDuration, maxSlotDuration)
+	}
+	return duration, nil
+}
+
+// rescheduleSlotInput moves a booking to a slot on date, both in the time
+// zone of the organizer of the booking
+type rescheduleSlotInput struct {
+	BookingID  int        `json:"booking_id"`
+	Date       string     `json:"date"`
+	Slot       string     `json:"slot"`
+	TimeZone   string     `json:"time_zone"`
+	SlotConfig slotConfig `json:"slot_lookup_config"`
+}
+
+// cancelSlotInput cancels a single booking, or with series the upcoming
+// occurrences of the series the booking belongs to
+type cancelSlotInput struct {
+	BookingID int    `json:"booking_id"`
+	Reason    string `json:"reason"`
+	Series    bool   `json:"series"`
 }
 
 type availabilityInput struct {
@@ -164,8 +869,108 @@ type availabilityInput struct {
 	EndTimeMinutes   int    `json:"end_time_minutes"`
 }
 
+type availabilityWindow struct {
+	StartTimeHour    int `json:"start_time_hour"`
+	StartTimeMinutes int `json:"start_time_minutes"`
+	EndTimeHour      int `json:"end_time_hour"`
+	EndTimeMinutes   int `json:"end_time_minutes"`
+}
+
+// updateAvailabilityInput replaces every window of a weekday, an empty
+// list of windows clears the day
+type updateAvailabilityInput struct {
+	UserID  string               `json:"user_id"`
+	Day     string               `json:"day"`
+	Windows []availabilityWindow `json:"windows"`
+}
+
+// availabilityOverrideInput sets the windows for every date from start_date
+// to end_date (inclusive), an empty list of windows marks the range as time
+// off. end_date defaults to start_date
+type availabilityOverrideInput struct {
+	UserID    string               `json:"user_id"`
+	StartDate string               `json:"start_date"`
+	EndDate   string               `json:"end_date"`
+	Windows   []availabilityWindow `json:"windows"`
+}
+
+// availabilityRuleInput repeats windows following recurrence from start_date,
+// until end_date when set
+type availabilityRuleInput struct {
+	UserID     string               `json:"user_id"`
+	Recurrence string               `json:"recurrence"`
+	StartDate  string               `json:"start_date"`
+	EndDate    string               `json:"end_date"`
+	Windows    []availabilityWindow `json:"windows"`
+}
+
+// externalCalendarInput registers a local iCalendar file as busy time
+type externalCalendarInput struct {
+	UserID int    `json:"user_id"`
+	Path   string `json:"path"`
+}
+
+type deleteExternalCalendarInput struct {
+	UserID     int `json:"user_id"`
+	CalendarID int `json:"calendar_id"`
+}
+
+type deleteAvailabilityRuleInput struct {
+	UserID string `json:"user_id"`
+	RuleID int    `json:"rule_id"`
+}
+
 type userInput struct {
-	Name string `json:"name"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`     // optional, invites are emailed to it
+	TimeZone string `json:"time_zone"` // IANA name, e.g. Asia/Kolkata, defaults to UTC
+}
+
+// emailInput sets the address invites are sent to, an empty one stops them
+type emailInput struct {
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+type timeZoneInput struct {
+	UserID   int    `json:"user_id"`
+	TimeZone string `json:"time_zone"`
+}
+
+// noticeInput sets how long ahead a user has to be booked, at least
+// min_notice_minutes and at most max_horizon_days (0 for no limit)
+type noticeInput struct {
+	UserID           int `json:"user_id"`
+	MinNoticeMinutes int `json:"min_notice_minutes"`
+	MaxHorizonDays   int `json:"max_horizon_days"`
+}
+
+// meetingCaps limit how many meetings, or meeting minutes, a user takes per
+// day and per week (starting on monday) in their own time zone, 0 for no limit
+type meetingCaps struct {
+	MaxMeetingsPerDay  int `json:"max_meetings_per_day"`
+	MaxMinutesPerDay   int `json:"max_minutes_per_day"`
+	MaxMeetingsPerWeek int `json:"max_meetings_per_week"`
+	MaxMinutesPerWeek  int `json:"max_minutes_per_week"`
+}
+
+type meetingCapsInput struct {
+	UserID int `json:"user_id"`
+	meetingCaps
+}
+
+// error codes returned when a booking would go over a cap
+const (
+	dailyCapReached  = "daily_cap_reached"
+	weeklyCapReached = "weekly_cap_reached"
+)
+
+// bufferInput sets the free minutes a user keeps before and after each of
+// their meetings
+type bufferInput struct {
+	UserID        int `json:"user_id"`
+	BeforeMinutes int `json:"buffer_before_minutes"`
+	AfterMinutes  int `json:"buffer_after_minutes"`
 }
 
 // end of business logic types
@@ -195,6 +1000,23 @@ func createUser(c *gin.Context) {
 		})
 		return
 	}
+	if !validEmail(user.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid email address",
+		})
+		return
+	}
+	if len(user.TimeZone) == 0 {
+		user.TimeZone = "UTC"
+	}
+	if _, err = time.LoadLocation(user.TimeZone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid time zone, kindly use an IANA name such as Europe/Berlin",
+		})
+		return
+	}
 	// Create an insert statement to be executed on the database
 	db, err := sql.Open("sqlite3", file)
 	if err != nil {
@@ -205,7 +1027,7 @@ func createUser(c *gin.Context) {
 		return
 	}
 	defer db.Close()
-	res, err := db.Exec(insertUser, user.Name)
+	res, err := db.Exec(insertUser, user.Name, user.Email, user.TimeZone)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
@@ -227,110 +1049,64 @@ func createUser(c *gin.Context) {
 	})
 }
 
-// viewSchedule will allow users to view availability on a particular day
-func viewSchedule(c *gin.Context) {
+// setTimeZone changes the IANA time zone a user's availability is read in
+func setTimeZone(c *gin.Context) {
 	jsonData, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "invalid request body",
+			"message": "invalid request payload",
 		})
 		return
 	}
-	var viewSchedule viewScheduleInput
-	err = json.Unmarshal(jsonData, &viewSchedule)
+	var timeZone timeZoneInput
+	err = json.Unmarshal(jsonData, &timeZone)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "invalid request body",
+			"message": "invalid request payload",
 		})
 		return
 	}
-
-	// Parse the date
-	layout := "2006-01-02"
-	t, err := time.Parse(layout, viewSchedule.Date)
-	if err != nil {
+	if _, err = time.LoadLocation(timeZone.TimeZone); err != nil || len(timeZone.TimeZone) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+			"message": "invalid time zone, kindly use an IANA name such as Europe/Berlin",
 		})
 		return
 	}
-	dayOfTheWeek := dayOfTheWeekMap[t.Weekday()]
-
-	// Create an insert statement to be executed on the database
 	db, err := sql.Open("sqlite3", file)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "something went wrong",
+			"message": "internal error",
 		})
 		return
 	}
 	defer db.Close()
-	user, err := getUserAvailability(viewSchedule.UserID, dayOfTheWeek)
+	res, err := db.Exec(updateUserTimeZone, timeZone.TimeZone, timeZone.UserID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "unable to get availability",
+			"message": "unable to set time zone",
 		})
 		return
 	}
-	userSlot := make(map[int]availabilityStatus)
-	userSlotInfo := make(map[int]availabilityInfo)
-
-	// tip: this function update's the map by reference
-	err = buildSlotAvailability(user, &userSlot, &userSlotInfo, hourly, 60)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status":  "error",
-			"message": "unable to get availability",
-		})
-		return
-	}
-	bookedSlots, err := db.Query(getSingleUserBookedSlots, viewSchedule.UserID, viewSchedule.UserID, viewSchedule.Date)
-	if err != nil {
+	if updated, err := res.RowsAffected(); err != nil || updated < 1 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "unable to get booked slots",
+			"message": "user not found",
 		})
 		return
 	}
 
-	for bookedSlots.Next() {
-		var slot scheduledSlot
-		if err := bookedSlots.Scan(&slot.UserID1, &slot.UserID2, &slot.Date, &slot.StartTimeHour, &slot.StartTimeMinutes, &slot.EndTimeHour, &slot.EndTimeMinutes, &slot.SlotDuration); err != nil {
-			fmt.Println(err)
-			// TODO: handle error
-		}
-		if slot.UserID1 == viewSchedule.UserID {
-			userSlot[slot.UserID1][fmt.Sprintf("%02d:%02d", slot.StartTimeHour, slot.StartTimeMinutes)] = false
-		}
-		if slot.UserID2 == viewSchedule.UserID {
-			userSlot[slot.UserID2][fmt.Sprintf("%02d:%02d", slot.StartTimeHour, slot.StartTimeMinutes)] = false
-		}
-	}
-	userSlots := userSlot[viewSchedule.UserID]
-	var availableSlots = []string{}
-	var bs = []string{}
-	for k, v := range userSlots {
-		if !v {
-			bs = append(bs, k)
-		} else {
-			availableSlots = append(availableSlots, k)
-		}
-	}
 	c.JSON(http.StatusOK, gin.H{
-		"date":            viewSchedule.Date,
-		"booked_slots":    bs,
-		"available_slots": availableSlots,
+		"status": "success",
 	})
 }
 
-// setAvailability will allow users to set availability on a particular day
-// of the week
-func setAvailability(c *gin.Context) {
+// setEmail changes the address a user gets invites at
+func setEmail(c *gin.Context) {
 	jsonData, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -339,8 +1115,8 @@ func setAvailability(c *gin.Context) {
 		})
 		return
 	}
-	var availability availabilityInput
-	err = json.Unmarshal(jsonData, &availability)
+	var email emailInput
+	err = json.Unmarshal(jsonData, &email)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
@@ -348,60 +1124,90 @@ func setAvailability(c *gin.Context) {
 		})
 		return
 	}
-	startHourMinute, err := mergeToHourMinute(availability.StartTimeHour, availability.StartTimeMinutes)
+	if !validEmail(email.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid email address",
+		})
+		return
+	}
+	db, err := sql.Open("sqlite3", file)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "unable to parse start time",
+			"message": "internal error",
 		})
 		return
 	}
-	endHourMinute, err := mergeToHourMinute(availability.EndTimeHour, availability.EndTimeMinutes)
+	defer db.Close()
+	res, err := db.Exec(updateUserEmail, email.Email, email.UserID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "unable to parse end time",
+			"message": "unable to set email",
 		})
 		return
 	}
-	if startHourMinute >= endHourMinute {
+	if updated, err := res.RowsAffected(); err != nil || updated < 1 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "start and end time cannot be equal or greater than end time",
+			"message": "user not found",
 		})
 		return
 	}
-	// Create an insert statement to be executed on the database
-	db, err := sql.Open("sqlite3", file)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// setBuffer changes the buffer a user keeps before and after meetings
+func setBuffer(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "internal error",
+			"message": "invalid request payload",
 		})
 		return
 	}
-	defer db.Close()
-
-	res, err := db.Exec(insertAvailability, availability.UserID, availability.Day, availability.StartTimeHour, availability.StartTimeMinutes, availability.EndTimeHour, availability.EndTimeMinutes)
+	var buffer bufferInput
+	err = json.Unmarshal(jsonData, &buffer)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "unable to set availability",
+			"message": "invalid request payload",
 		})
 		return
 	}
-	var id int64
-	if id, err = res.RowsAffected(); err != nil {
+	if buffer.BeforeMinutes < 0 || buffer.BeforeMinutes > maxBufferMinutes || buffer.AfterMinutes < 0 || buffer.AfterMinutes > maxBufferMinutes {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": err.Error(),
+			"message": fmt.Sprintf("buffers have to be between 0 and %d minutes", maxBufferMinutes),
 		})
 		return
 	}
-	if id < 1 {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "something went wrong",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+	res, err := db.Exec(updateUserBuffer, buffer.BeforeMinutes, buffer.AfterMinutes, buffer.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to set buffer",
+		})
+		return
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "user not found",
 		})
 		return
 	}
@@ -411,139 +1217,116 @@ func setAvailability(c *gin.Context) {
 	})
 }
 
-// bookSlot invokes
-// build in function to identify calendar diff for
-// user 1 and user 2
-// returns slot's that are available on a given day
-// considering the already booked slots
-func bookSlot(c *gin.Context) {
+// setNotice changes the minimum notice and the booking horizon of a user
+func setNotice(c *gin.Context) {
 	jsonData, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "invalid request body",
+			"message": "invalid request payload",
 		})
 		return
 	}
-	var bookInput bookSlotInput
-	err = json.Unmarshal(jsonData, &bookInput)
+	var notice noticeInput
+	err = json.Unmarshal(jsonData, &notice)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "invalid request body",
+			"message": "invalid request payload",
 		})
 		return
 	}
-	if bookInput.UserID1 == bookInput.UserID2 {
+	if notice.MinNoticeMinutes < 0 || notice.MinNoticeMinutes > maxNoticeMinutes {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "User 1 and User 2 cannot be same",
+			"message": fmt.Sprintf("minimum notice has to be between 0 and %d minutes", maxNoticeMinutes),
 		})
 		return
 	}
-
-	// Parse the date
-	layout := "2006-01-02"
-	t, err := time.Parse(layout, bookInput.Date)
-	if err != nil {
+	if notice.MaxHorizonDays < 0 || notice.MaxHorizonDays > maxHorizonDays {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+			"message": fmt.Sprintf("horizon has to be between 0 (no limit) and %d days", maxHorizonDays),
 		})
 		return
 	}
-
-	dayOfTheWeek := dayOfTheWeekMap[t.Weekday()]
-	if bookInput.SlotConfig.Every < 15 || bookInput.SlotConfig.Every > 60 {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "minumum search interval is 15 mins and max is 60 minutes period",
+			"message": "internal error",
 		})
 		return
 	}
-
-	userSlotPtr, userSlotMapPtr, err := getSlotDiffs(slotInput{
-		UserID1:    bookInput.UserID1,
-		UserID2:    bookInput.UserID2,
-		Date:       bookInput.Date,
-		SlotConfig: bookInput.SlotConfig,
-	}, dayOfTheWeek, bookInput.SlotConfig.Every)
-
+	defer db.Close()
+	res, err := db.Exec(updateUserNotice, notice.MinNoticeMinutes, notice.MaxHorizonDays, notice.UserID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "something went wrong",
+			"status":  "error",
+			"message": "unable to set notice",
+		})
+		return
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "user not found",
 		})
 		return
 	}
 
-	userSlot := *userSlotPtr
-	userSlotInfo := *userSlotMapPtr
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
 
-	// Now for every slot in user 1, find out if the same slot is available in user 2 or not and append and return
-	user1Slots := userSlot[bookInput.UserID1]
-	user2Slots := userSlot[bookInput.UserID2]
-	// var availableSlots []string
-	availableSlotsMap := make(map[string]bool)
-	for slot, availability := range user1Slots {
-		if availability {
-			if user2Slots[slot] {
-				// availableSlots = append(availableSlots, slot)
-				availableSlotsMap[slot] = true
-			}
-		}
+// setMeetingCaps changes the daily and weekly caps of a user
+func setMeetingCaps(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
 	}
-
-	// Create an insert statement to be executed on the database
-	db, err := sql.Open("sqlite3", file)
+	var caps meetingCapsInput
+	err = json.Unmarshal(jsonData, &caps)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "something went wrong",
+			"message": "invalid request payload",
 		})
 		return
 	}
-	defer db.Close()
-
-	if !availableSlotsMap[bookInput.Slot] {
+	if caps.MaxMeetingsPerDay < 0 || caps.MaxMinutesPerDay < 0 || caps.MaxMeetingsPerWeek < 0 || caps.MaxMinutesPerWeek < 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "slot unavailable",
+			"message": "caps cannot be negative, kindly use 0 for no limit",
 		})
 		return
 	}
-	// insert
-	user1 := bookInput.UserID1
-	user2 := bookInput.UserID2
-	slot := bookInput.Slot
-	slotResponse, err := db.Exec(insertSlot,
-		user1,
-		user2,
-		bookInput.Date,
-		userSlotInfo[user1][slot].StartTimeHour,
-		userSlotInfo[user1][slot].StartTimeMinutes,
-		userSlotInfo[user1][slot].EndTimeHour,
-		userSlotInfo[user1][slot].EndTimeMinutes,
-		bookInput.SlotConfig.SlotDuration,
-	)
+	db, err := sql.Open("sqlite3", file)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "unable to confirm the slot",
+			"message": "internal error",
 		})
 		return
 	}
-	var id int64
-	if id, err = slotResponse.RowsAffected(); err != nil {
+	defer db.Close()
+	res, err := db.Exec(updateUserMeetingCaps, caps.MaxMeetingsPerDay, caps.MaxMinutesPerDay, caps.MaxMeetingsPerWeek, caps.MaxMinutesPerWeek, caps.UserID)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": err.Error(),
+			"message": "unable to set caps",
 		})
 		return
 	}
-	if id < 1 {
+	if updated, err := res.RowsAffected(); err != nil || updated < 1 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "something went wrong",
+			"message": "user not found",
 		})
 		return
 	}
@@ -553,12 +1336,8 @@ func bookSlot(c *gin.Context) {
 	})
 }
 
-// findAvailableSlots invokes
-// build in function to identify calendar diff for
-// user 1 and user 2
-// returns slot's that are available on a given day
-// considering the already booked slots
-func findAvailableSlots(c *gin.Context) {
+// viewSchedule will allow users to view availability on a particular day
+func viewSchedule(c *gin.Context) {
 	jsonData, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -567,8 +1346,8 @@ func findAvailableSlots(c *gin.Context) {
 		})
 		return
 	}
-	var findSlotInput findAvailableSlotInput
-	err = json.Unmarshal(jsonData, &findSlotInput)
+	var viewSchedule viewScheduleInput
+	err = json.Unmarshal(jsonData, &viewSchedule)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
@@ -577,239 +1356,4614 @@ func findAvailableSlots(c *gin.Context) {
 		return
 	}
 
-	if findSlotInput.UserID1 == findSlotInput.UserID2 {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "User 1 and User 2 cannot be same",
+			"message": "something went wrong",
 		})
 		return
 	}
+	defer db.Close()
 
-	// Parse the date
-	layout := "2006-01-02"
-	t, err := time.Parse(layout, findSlotInput.Date)
-	if err != nil {
+	loc, err := requestLocation(db, viewSchedule.TimeZone, viewSchedule.UserID)
+	if errors.Is(err, errInvalidTimeZone) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+			"message": err.Error(),
 		})
 		return
 	}
-
-	dayOfTheWeek := dayOfTheWeekMap[t.Weekday()]
-
-	if findSlotInput.SlotConfig.Every < 15 || findSlotInput.SlotConfig.Every > 60 {
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "minumum search interval is 15 mins and max is 60 minutes period",
+			"message": "unable to get user",
 		})
 		return
 	}
 
-	userSlotPtr, _, err := getSlotDiffs(slotInput{
-		UserID1:    findSlotInput.UserID1,
-		UserID2:    findSlotInput.UserID2,
-		Date:       findSlotInput.Date,
-		SlotConfig: findSlotInput.SlotConfig,
-	}, dayOfTheWeek, findSlotInput.SlotConfig.Every)
-
+	// Parse the date, in the time zone of the caller
+	layout := "2006-01-02"
+	t, err := time.ParseInLocation(layout, viewSchedule.Date, loc)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": "something went wrong",
+			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
 		})
 		return
 	}
-
-	userSlot := *userSlotPtr
-	// userSlotInfo := *userSlotMapPtr
-
-	// Now for every slot in user 1, find out if the same slot is available in user 2 or not and append and return
-	user1Slots := userSlot[findSlotInput.UserID1]
-	user2Slots := userSlot[findSlotInput.UserID2]
-	var availableSlots []string
-	availableSlotsMap := make(map[string]bool)
-	for slot, availability := range user1Slots {
-		if availability {
-			if user2Slots[slot] {
-				availableSlots = append(availableSlots, slot)
-				availableSlotsMap[slot] = true
-			}
-		}
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"date":  findSlotInput.Date,
-		"slots": availableSlots,
-	})
-}
-
-// retrieves availability set by user on a given weekday
-// // simple lookup against database
-func getUserAvailability(user int, dayOfTheWeek string) (userAvailability, error) {
-	var userAvailabilityStatus = userAvailability{}
-	db, err := sql.Open("sqlite3", file)
-	if err != nil {
-		return userAvailabilityStatus, errors.New("error opening a database connection")
-	}
-	defer db.Close()
-
-	res := db.QueryRow(getUserAvailabilitySetting, user, dayOfTheWeek)
-
-	if err = res.Scan(&userAvailabilityStatus.UserId, &userAvailabilityStatus.StartTimeHour, &userAvailabilityStatus.StartTimeMinutes, &userAvailabilityStatus.EndTimeHour, &userAvailabilityStatus.EndTimeMinutes); err == sql.ErrNoRows {
-		return userAvailabilityStatus, err
+	if isPastDate(t) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "date cannot be in the past",
+		})
+		return
 	}
-	return userAvailabilityStatus, nil
-}
+	dayEnd := t.AddDate(0, 0, 1)
 
-// utility
-func mergeToHourMinute(hour int, minute int) (int, error) {
-	hourMinuteStr := fmt.Sprintf("%02d%02d", hour, minute)
-	hourMinute, err := strconv.Atoi(hourMinuteStr)
+	user, err := getUserWindows(db, viewSchedule.UserID, t, dayEnd)
 	if err != nil {
-		return 0, err
-	}
-	return hourMinute, nil
-}
-func splitHourMinute(hourMinute int) (hour int, minute int) {
-	hour = hourMinute / 100
-	minute = hourMinute % 100
-	return hour, minute
-}
-
-func addToHourMinute(hourMinute int, duration int) (int, error) {
-	hour := hourMinute / 100
-	minute := (hourMinute % 100) + duration
-
-	if minute >= 60 {
-		hour += 1
-		minute = minute % 60
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get availability",
+		})
+		return
 	}
-	return mergeToHourMinute(hour, minute)
-}
-
-// end of utility
+	userSlot := make(map[int]availabilityStatus)
+	userSlotInfo := make(map[int]availabilityInfo)
 
-// buildSlotAvailability builds a map with key representing hh:mm formatted slot in the
-// provided interval (hourly, half-hourly)
-func buildSlotAvailability(user userAvailability, userSlot *map[int]availabilityStatus, userSlotInfo *map[int]availabilityInfo, requestedDuration slotDuration, every int) error {
-	startHourMinute, err := mergeToHourMinute(user.StartTimeHour, user.StartTimeMinutes)
+	// tip: this function update's the map by reference
+	err = buildSlotAvailability(viewSchedule.UserID, user, loc, &userSlot, &userSlotInfo, durationToInt[hourly], 60)
 	if err != nil {
-		return err
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get availability",
+		})
+		return
 	}
-
-	endHourMinute, err := mergeToHourMinute(user.EndTimeHour, user.EndTimeMinutes)
-
+	bookedSlots, err := db.Query(getUserBookedSlots, viewSchedule.UserID, formatTimestamp(dayEnd), formatTimestamp(t), 0)
 	if err != nil {
-		return err
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get booked slots",
+		})
+		return
 	}
 
-	duration := durationToInt[requestedDuration]
+	defer bookedSlots.Close()
 
-	for startHourMinute < endHourMinute {
-		// Check if user map exists
-		if _, ok := (*userSlot)[user.UserId]; !ok {
-			(*userSlot)[user.UserId] = make(map[string]bool)
-			(*userSlotInfo)[user.UserId] = make(map[string]userAvailability)
-		}
-		startHour, startMinute := splitHourMinute(startHourMinute)
-		// userSlot[user1.UserId][fmt.Sprintf("%d:%d-%d:%d", startHourUser1, user1.StartTimeMinutes, startHourUser1, ((user2.StartTimeMinutes+60)-1))] = true
-		// Check if we can schedule a 1 hour slot from start time
-		startHourMinuteChecker, err := addToHourMinute(startHourMinute, duration)
+	var bs = []slotView{}
+	for bookedSlots.Next() {
+		slot, err := scanScheduledSlot(bookedSlots)
 		if err != nil {
-			return err
-		}
-
-		if startHourMinuteChecker > endHourMinute {
-			break
+			fmt.Println(err)
+			// TODO: handle error
 		}
-		endMinuteComputer, err := addToHourMinute(startHourMinute, duration)
+		booked, err := slot.timeRange()
 		if err != nil {
-			return err
+			fmt.Println(err)
+			continue
 		}
-		endHour, endMinute := splitHourMinute(endMinuteComputer)
-		if endMinute == 0 {
-			endMinute = 60
-			endHour -= 1
+		// slots overlapping the booking are no longer available, the
+		// booking itself is shown in the viewer's time zone
+		for key, slotRange := range userSlotInfo[viewSchedule.UserID] {
+			if slotRange.overlaps(booked) {
+				delete(userSlot[viewSchedule.UserID], key)
+			}
 		}
-
-		(*userSlot)[user.UserId][fmt.Sprintf("%02d:%02d", startHour, startMinute)] = true
-		(*userSlotInfo)[user.UserId][fmt.Sprintf("%02d:%02d", startHour, startMinute)] = userAvailability{
-			StartTimeHour:    startHour,
-			StartTimeMinutes: startMinute,
-			EndTimeHour:      endHour,
-			EndTimeMinutes:   endMinute - 1,
+		view := newSlotView(booked, loc)
+		view.ID = slot.ID
+		bs = append(bs, view)
+	}
+	// busy time from external calendars
+	busy, err := getUserExternalBusy(db, viewSchedule.UserID, t, dayEnd)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get external calendars",
+		})
+		return
+	}
+	var busySlots = []slotView{}
+	for _, r := range busy {
+		for key, slotRange := range userSlotInfo[viewSchedule.UserID] {
+			if slotRange.overlaps(r) {
+				delete(userSlot[viewSchedule.UserID], key)
+			}
 		}
-		// But do this every `every`
-		startHourMinute, err = addToHourMinute(startHourMinute, every)
-		if err != nil {
-			return err
+		busySlots = append(busySlots, newSlotView(r, loc))
+	}
+	var availableSlots = []slotView{}
+	for key, available := range userSlot[viewSchedule.UserID] {
+		if available {
+			availableSlots = append(availableSlots, newSlotView(userSlotInfo[viewSchedule.UserID][key], loc))
 		}
 	}
-	return nil
+	sortSlotViews(bs)
+	sortSlotViews(busySlots)
+	sortSlotViews(availableSlots)
+
+	if viewSchedule.LegacyFormat {
+		legacyBooked, _ := legacySlots(bs)
+		legacyBusy, _ := legacySlots(busySlots)
+		legacyAvailable, _ := legacySlots(availableSlots)
+		c.JSON(http.StatusOK, gin.H{
+			"date":            viewSchedule.Date,
+			"time_zone":       loc.String(),
+			"booked_slots":    legacyBooked,
+			"busy_slots":      legacyBusy,
+			"available_slots": legacyAvailable,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"date":            viewSchedule.Date,
+		"time_zone":       loc.String(),
+		"booked_slots":    bs,
+		"busy_slots":      busySlots,
+		"available_slots": availableSlots,
+	})
+}
+
+// setAvailability will allow users to set availability on a particular day
+// of the week
+func setAvailability(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var availability availabilityInput
+	err = json.Unmarshal(jsonData, &availability)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	startHourMinute, err := mergeToHourMinute(availability.StartTimeHour, availability.StartTimeMinutes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to parse start time",
+		})
+		return
+	}
+	endHourMinute, err := mergeToHourMinute(availability.EndTimeHour, availability.EndTimeMinutes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to parse end time",
+		})
+		return
+	}
+	if startHourMinute >= endHourMinute {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "start and end time cannot be equal or greater than end time",
+		})
+		return
+	}
+	// Create an insert statement to be executed on the database
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	// a weekday can hold several windows (split shifts) as long as they don't overlap
+	userID, err := strconv.Atoi(availability.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid user id",
+		})
+		return
+	}
+	// the overlap check and the insert share a transaction holding the write
+	// lock, so that concurrent requests can't both add overlapping windows
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	windows, err := getUserWeeklyAvailability(tx, userID, availability.Day)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get availability",
+		})
+		return
+	}
+	for _, window := range windows {
+		windowStart, _ := mergeToHourMinute(window.StartTimeHour, window.StartTimeMinutes)
+		windowEnd, _ := mergeToHourMinute(window.EndTimeHour, window.EndTimeMinutes)
+		if startHourMinute < windowEnd && windowStart < endHourMinute {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("availability overlaps with the existing window %02d:%02d-%02d:%02d", window.StartTimeHour, window.StartTimeMinutes, window.EndTimeHour, window.EndTimeMinutes),
+			})
+			return
+		}
+	}
+
+	res, err := tx.Exec(insertAvailability, availability.UserID, availability.Day, availability.StartTimeHour, availability.StartTimeMinutes, availability.EndTimeHour, availability.EndTimeMinutes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to set availability",
+		})
+		return
+	}
+	var id int64
+	if id, err = res.RowsAffected(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if id < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to set availability",
+		})
+		return
+	}
+
+	notifyWebhooks(webhookAvailabilityChanged, gin.H{"user_id": userID, "kind": "weekly"})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// updateAvailability replaces the availability windows of a user on a
+// particular day of the week, bookings that fall outside the new windows
+// are reported back as conflicts
+func updateAvailability(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var availability updateAvailabilityInput
+	err = json.Unmarshal(jsonData, &availability)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	replaceAvailability(c, availability)
+}
+
+// deleteAvailability clears the availability windows of a user on a
+// particular day of the week, bookings on that day are reported back as
+// conflicts
+func deleteAvailability(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var availability updateAvailabilityInput
+	err = json.Unmarshal(jsonData, &availability)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	availability.Windows = nil
+	replaceAvailability(c, availability)
+}
+
+// replaceAvailability swaps the windows of a weekday in a single transaction
+func replaceAvailability(c *gin.Context, availability updateAvailabilityInput) {
+	userID, err := strconv.Atoi(availability.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid user id",
+		})
+		return
+	}
+	weekday, ok := weekdayFromName(availability.Day)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid day, kindly use monday, tuesday, wednesday, thursday, friday, saturday or sunday",
+		})
+		return
+	}
+	if err = validateAvailabilityWindows(availability.Windows); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(deleteUserAvailability, userID, availability.Day); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to update availability",
+		})
+		return
+	}
+	for _, window := range availability.Windows {
+		if _, err = tx.Exec(insertAvailability, userID, availability.Day, window.StartTimeHour, window.StartTimeMinutes, window.EndTimeHour, window.EndTimeMinutes); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to update availability",
+			})
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to update availability",
+		})
+		return
+	}
+
+	notifyWebhooks(webhookAvailabilityChanged, gin.H{"user_id": userID, "kind": "weekly"})
+
+	conflicts, err := getAvailabilityConflicts(db, userID, weekday)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "availability updated, unable to get the conflicting bookings",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"conflicts": conflicts,
+	})
+}
+
+// getAvailabilityConflicts lists the upcoming bookings of a user on the given
+// weekday, in the user's time zone, that no longer fit in the availability.
+// The availability is resolved the way bookings are checked against it,
+// rules and overrides included, so the change has to be committed first
+func getAvailabilityConflicts(q querier, user int, weekday time.Weekday) ([]scheduledSlot, error) {
+	loc, err := getUserLocation(q, user)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(getUserUpcomingBookedSlots, user, formatTimestamp(now()))
+	if err != nil {
+		return nil, err
+	}
+	var slots []scheduledSlot
+	for rows.Next() {
+		slot, err := scanScheduledSlot(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	conflicts := []scheduledSlot{}
+	for _, slot := range slots {
+		booked, err := slot.timeRange()
+		if err != nil {
+			return nil, err
+		}
+		if booked.Start.In(loc).Weekday() != weekday {
+			continue
+		}
+		windows, err := getUserWindows(q, user, booked.Start, booked.End)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if !booked.within(mergeTimeRanges(windows, booked)) {
+			conflicts = append(conflicts, slot)
+		}
+	}
+	return conflicts, nil
+}
+
+// setAvailabilityRule adds windows repeating following an RRULE, such as
+// every other friday or the first monday of the month, on top of the weekly
+// pattern
+func setAvailabilityRule(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var rule availabilityRuleInput
+	err = json.Unmarshal(jsonData, &rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	userID, err := strconv.Atoi(rule.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid user id",
+		})
+		return
+	}
+	recurrence, err := parseRecurrence(rule.Recurrence, time.UTC)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, rule.StartDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+		})
+		return
+	}
+	var endDate any
+	if len(rule.EndDate) > 0 {
+		end, err := time.Parse(layout, rule.EndDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+			})
+			return
+		}
+		if end.Before(startDate) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "end date cannot be before start date",
+			})
+			return
+		}
+		endDate = end.Format(layout)
+	}
+	// the rule ends on its last occurrence when it has a COUNT, so that
+	// looking it up doesn't take expanding it
+	if recurrence.Count > 0 {
+		last := recurrence.bounded(startDate).Until
+		if last.Before(startDate) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "recurrence has no occurrence",
+			})
+			return
+		}
+		if endDate == nil || last.Format(layout) < endDate.(string) {
+			endDate = last.Format(layout)
+		}
+	}
+	if len(rule.Windows) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "a rule needs at least one window",
+		})
+		return
+	}
+	if err = validateAvailabilityWindows(rule.Windows); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	ids := []int64{}
+	for _, window := range rule.Windows {
+		res, err := tx.Exec(insertAvailabilityRule, userID, rule.Recurrence, startDate.Format(layout), endDate, window.StartTimeHour, window.StartTimeMinutes, window.EndTimeHour, window.EndTimeMinutes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to set availability rule",
+			})
+			return
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+		ids = append(ids, id)
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to set availability rule",
+		})
+		return
+	}
+
+	notifyWebhooks(webhookAvailabilityChanged, gin.H{"user_id": userID, "kind": "rule"})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"rule_ids": ids,
+	})
+}
+
+// deleteAvailabilityRule drops a window added with setAvailabilityRule
+func deleteAvailabilityRule(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var rule deleteAvailabilityRuleInput
+	err = json.Unmarshal(jsonData, &rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	userID, err := strconv.Atoi(rule.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid user id",
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	res, err := db.Exec(deleteUserAvailabilityRule, rule.RuleID, userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to delete availability rule",
+		})
+		return
+	}
+	if deleted, err := res.RowsAffected(); err != nil || deleted < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "availability rule not found",
+		})
+		return
+	}
+
+	notifyWebhooks(webhookAvailabilityChanged, gin.H{"user_id": userID, "kind": "rule"})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// setAvailabilityOverride replaces the availability of a user on a range of
+// calendar dates, either with new windows or with time off
+func setAvailabilityOverride(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var override availabilityOverrideInput
+	err = json.Unmarshal(jsonData, &override)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	userID, startDate, endDate, ok := parseAvailabilityOverride(c, &override)
+	if !ok {
+		return
+	}
+	if err = validateAvailabilityWindows(override.Windows); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// the new override replaces the earlier ones on its dates
+	if _, err = clearAvailabilityOverrides(tx, userID, startDate, endDate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to set availability override",
+		})
+		return
+	}
+	if len(override.Windows) == 0 {
+		_, err = tx.Exec(insertAvailabilityOverride, userID, startDate, endDate, false, nil, nil, nil, nil)
+	}
+	for _, window := range override.Windows {
+		if _, err = tx.Exec(insertAvailabilityOverride, userID, startDate, endDate, true, window.StartTimeHour, window.StartTimeMinutes, window.EndTimeHour, window.EndTimeMinutes); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to set availability override",
+		})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to set availability override",
+		})
+		return
+	}
+
+	notifyWebhooks(webhookAvailabilityChanged, gin.H{"user_id": userID, "kind": "override"})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// deleteAvailabilityOverride clears the overrides of a range of calendar
+// dates so that the weekly pattern applies again
+func deleteAvailabilityOverride(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var override availabilityOverrideInput
+	err = json.Unmarshal(jsonData, &override)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	userID, startDate, endDate, ok := parseAvailabilityOverride(c, &override)
+	if !ok {
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	deleted, err := clearAvailabilityOverrides(tx, userID, startDate, endDate)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to delete availability override",
+		})
+		return
+	}
+
+	notifyWebhooks(webhookAvailabilityChanged, gin.H{"user_id": userID, "kind": "override"})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"deleted": deleted,
+	})
+}
+
+// availabilityOverride is a stored override window, or time off when it is
+// not available
+type availabilityOverride struct {
+	ID        int
+	StartDate string
+	EndDate   string
+	Available bool
+	Window    userAvailability
+}
+
+// getAvailabilityOverrides lists the overrides of a user overlapping the dates
+// from to to, the most recent first
+func getAvailabilityOverrides(q querier, user int, from string, to string) ([]availabilityOverride, error) {
+	rows, err := q.Query(getUserAvailabilityOverrides, user, to, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []availabilityOverride
+	for rows.Next() {
+		var override availabilityOverride
+		var startHour, startMinutes, endHour, endMinutes sql.NullInt64
+		if err = rows.Scan(&override.ID, &override.Window.UserId, &override.StartDate, &override.EndDate, &override.Available, &startHour, &startMinutes, &endHour, &endMinutes); err != nil {
+			return nil, err
+		}
+		override.Window.StartTimeHour, override.Window.StartTimeMinutes = int(startHour.Int64), int(startMinutes.Int64)
+		override.Window.EndTimeHour, override.Window.EndTimeMinutes = int(endHour.Int64), int(endMinutes.Int64)
+		overrides = append(overrides, override)
+	}
+	return overrides, rows.Err()
+}
+
+// clearAvailabilityOverrides removes the overrides of a user from the dates
+// from to to, the ones overlapping the range partly are cut down to their
+// dates outside of it. It returns the number of overrides removed or cut
+func clearAvailabilityOverrides(q querier, user int, from string, to string) (int64, error) {
+	overrides, err := getAvailabilityOverrides(q, user, from, to)
+	if err != nil {
+		return 0, err
+	}
+	layout := "2006-01-02"
+	first, err := time.Parse(layout, from)
+	if err != nil {
+		return 0, err
+	}
+	last, err := time.Parse(layout, to)
+	if err != nil {
+		return 0, err
+	}
+	before := first.AddDate(0, 0, -1).Format(layout)
+	after := last.AddDate(0, 0, 1).Format(layout)
+	for _, override := range overrides {
+		if _, err = q.Exec(deleteAvailabilityOverrideRow, override.ID); err != nil {
+			return 0, err
+		}
+		var kept [][2]string
+		if override.StartDate < from {
+			kept = append(kept, [2]string{override.StartDate, before})
+		}
+		if override.EndDate > to {
+			kept = append(kept, [2]string{after, override.EndDate})
+		}
+		for _, dates := range kept {
+			if override.Available {
+				window := override.Window
+				_, err = q.Exec(insertAvailabilityOverride, user, dates[0], dates[1], true, window.StartTimeHour, window.StartTimeMinutes, window.EndTimeHour, window.EndTimeMinutes)
+			} else {
+				_, err = q.Exec(insertAvailabilityOverride, user, dates[0], dates[1], false, nil, nil, nil, nil)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return int64(len(overrides)), nil
+}
+
+// parseAvailabilityOverride validates the user and the date range of an
+// override request, responding with an error when they are invalid
+func parseAvailabilityOverride(c *gin.Context, override *availabilityOverrideInput) (int, string, string, bool) {
+	userID, err := strconv.Atoi(override.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid user id",
+		})
+		return 0, "", "", false
+	}
+	if len(override.EndDate) == 0 {
+		override.EndDate = override.StartDate
+	}
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, override.StartDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+		})
+		return 0, "", "", false
+	}
+	endDate, err := time.Parse(layout, override.EndDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+		})
+		return 0, "", "", false
+	}
+	if endDate.Before(startDate) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "end date cannot be before start date",
+		})
+		return 0, "", "", false
+	}
+	return userID, startDate.Format(layout), endDate.Format(layout), true
+}
+
+// bookSlot invokes
+// build in function to identify calendar diff for
+// all the users
+// books the slot as one meeting when it is available
+// for every one of them, considering the already booked slots
+func bookSlot(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	var bookInput bookSlotInput
+	err = json.Unmarshal(jsonData, &bookInput)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	users, err := bookInput.participants()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	loc, err := requestLocation(db, bookInput.TimeZone, users[0])
+	if errors.Is(err, errInvalidTimeZone) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get the organizer",
+		})
+		return
+	}
+
+	// Parse the date, in the time zone of the caller
+	layout := "2006-01-02"
+	t, err := time.ParseInLocation(layout, bookInput.Date, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+		})
+		return
+	}
+	if isPastDate(t) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "date cannot be in the past",
+		})
+		return
+	}
+
+	if bookInput.SlotConfig.Every < 15 || bookInput.SlotConfig.Every > 60 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "minumum search interval is 15 mins and max is 60 minutes period",
+		})
+		return
+	}
+	if _, err = bookInput.SlotConfig.minutes(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// a single booking is the only occurrence of its date
+	dates := []time.Time{t}
+	if bookInput.Recurrence != "" {
+		// the occurrences start at the slot, which a date-time UNTIL is
+		// compared with
+		first := t
+		if at, err := time.Parse("15:04", bookInput.Slot); err == nil {
+			first = time.Date(t.Year(), t.Month(), t.Day(), at.Hour(), at.Minute(), 0, 0, loc)
+		} else if at, err := time.Parse(time.RFC3339, bookInput.Slot); err == nil {
+			first = at.In(loc)
+		}
+		rule, err := parseRecurrence(bookInput.Recurrence, loc)
+		if err == nil {
+			dates, err = rule.occurrences(first)
+		}
+		if err == nil && len(dates) == 0 {
+			err = errors.New("recurrence has no occurrence")
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	// the availability check and the insert run in one transaction, which
+	// holds the write lock, so concurrent bookings can't both pass the check
+	tx, err := db.Begin()
+	if isDatabaseBusy(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "the calendar is busy, try again",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if bookInput.Recurrence == "" {
+		slot, code, user, err := checkBookableSlot(tx, bookInput.slotInput, users, t, bookInput.Slot, 0)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": "unable to check the slot",
+			})
+			return
+		}
+		if code == dailyCapReached || code == weeklyCapReached {
+			c.JSON(http.StatusConflict, gin.H{
+				"status":  "error",
+				"code":    code,
+				"message": fmt.Sprintf("user %d has no room left for another meeting", user),
+			})
+			return
+		}
+		if code != "" {
+			c.JSON(http.StatusConflict, gin.H{
+				"status":  "error",
+				"message": "slot unavailable",
+			})
+			return
+		}
+
+		id, err := insertBooking(tx, users, slot, bookInput.SlotConfig, nil)
+		if isBookingOverlap(err) {
+			c.JSON(http.StatusConflict, gin.H{
+				"status":  "error",
+				"message": "slot unavailable",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to confirm the slot",
+			})
+			return
+		}
+		err = tx.Commit()
+		if isDatabaseBusy(err) {
+			c.JSON(http.StatusConflict, gin.H{
+				"status":  "error",
+				"message": "the calendar is busy, try again",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to confirm the slot",
+			})
+			return
+		}
+
+		notifyBookingWebhooks(db, webhookBookingCreated, []int64{id}, nil)
+		mailBookings(db, "REQUEST", []int64{id})
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "success",
+			"id":     id,
+		})
+		return
+	}
+
+	// every occurrence is checked and booked in turn, so that the meeting caps
+	// count the ones before it, the series is committed only when all of
+	// them are available
+	seriesResponse, err := tx.Exec(insertBookingSeries, users[0], bookInput.Recurrence)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to confirm the slot",
+		})
+		return
+	}
+	seriesID, err := seriesResponse.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	conflicts := []gin.H{}
+	occurrences := []gin.H{}
+	var ids []int64
+	for _, date := range dates {
+		slot, code, user, err := checkBookableSlot(tx, bookInput.slotInput, users, date, bookInput.Slot, 0)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": "unable to check the slot",
+			})
+			return
+		}
+		var id int64
+		if code == "" {
+			id, err = insertBooking(tx, users, slot, bookInput.SlotConfig, seriesID)
+			if isBookingOverlap(err) {
+				code = "slot_unavailable"
+			} else if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  "error",
+					"message": "unable to confirm the slot",
+				})
+				return
+			}
+		}
+		if code != "" {
+			conflict := gin.H{
+				"date": date.Format(layout),
+				"code": code,
+			}
+			if user != 0 {
+				conflict["user_id"] = user
+			}
+			conflicts = append(conflicts, conflict)
+			continue
+		}
+		ids = append(ids, id)
+		occurrences = append(occurrences, gin.H{
+			"id":        id,
+			"starts_at": formatTimestamp(slot.Start),
+			"ends_at":   formatTimestamp(slot.End),
+		})
+	}
+	if len(conflicts) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":    "error",
+			"message":   "some occurrences are unavailable",
+			"conflicts": conflicts,
+		})
+		return
+	}
+	err = tx.Commit()
+	if isDatabaseBusy(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "the calendar is busy, try again",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to confirm the slot",
+		})
+		return
+	}
+
+	notifyBookingWebhooks(db, webhookBookingCreated, ids, nil)
+	mailBookings(db, "REQUEST", ids)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"id":          occurrences[0]["id"],
+		"series_id":   seriesID,
+		"occurrences": occurrences,
+	})
+}
+
+// slotKey finds slot among slots, keyed by their UTC start. slot is either an
+// RFC 3339 timestamp or a wall clock "HH:MM" in loc, the earlier of the two
+// when the clocks are turned back and it happens twice
+func slotKey(slots availabilityInfo, slot string, loc *time.Location) (string, bool) {
+	if start, err := time.Parse(time.RFC3339, slot); err == nil {
+		key := formatTimestamp(start)
+		_, ok := slots[key]
+		return key, ok
+	}
+	var found string
+	for key, slotRange := range slots {
+		if slotRange.Start.In(loc).Format("15:04") == slot && (found == "" || key < found) {
+			found = key
+		}
+	}
+	return found, found != ""
+}
+
+// checkBookableSlot looks up slot on date for all the users, it returns the
+// slot's time range when it can be booked, or else why it can't: one of the
+// cap codes along with the user reaching it, "no_availability" or
+// "slot_unavailable". ignoreBooking is a booking being moved, which doesn't
+// block its own new slot
+func checkBookableSlot(q querier, input slotInput, users []int, date time.Time, slot string, ignoreBooking int) (timeRange, string, int, error) {
+	userSlotPtr, userSlotMapPtr, err := getSlotDiffs(q, input, date, input.SlotConfig.Every, ignoreBooking)
+	if errors.Is(err, errNoAvailability) {
+		return timeRange{}, "no_availability", 0, nil
+	}
+	if err != nil {
+		return timeRange{}, "", 0, err
+	}
+
+	userSlot := *userSlotPtr
+	userSlotInfo := *userSlotMapPtr
+
+	slot, ok := slotKey(userSlotInfo[users[0]], slot, date.Location())
+	slotRange := userSlotInfo[users[0]][slot]
+	if ok && availableForAll(userSlot, users, slot) {
+		return slotRange, "", 0, nil
+	}
+	// tell a cap apart from a slot that is simply taken
+	if ok {
+		user, code, err := findMeetingCapReached(q, users, slotRange, ignoreBooking)
+		if err != nil {
+			return timeRange{}, "", 0, err
+		}
+		if code != "" {
+			return slotRange, code, user, nil
+		}
+	}
+	return slotRange, "slot_unavailable", 0, nil
+}
+
+// insertBooking books slot for all the users, the first one being the
+// organizer. seriesID is nil for a single booking
+func insertBooking(tx *sql.Tx, users []int, slot timeRange, config slotConfig, seriesID any) (int64, error) {
+	// end minute is stored inclusive, e.g. 10:00 - 10:59
+	slotEnd := slot.End.Add(-time.Minute)
+	duration, _ := config.minutes()
+	slotResponse, err := tx.Exec(insertSlot,
+		users[0],
+		slot.Start.Format("2006-01-02"),
+		slot.Start.Hour(),
+		slot.Start.Minute(),
+		slotEnd.Hour(),
+		slotEnd.Minute(),
+		duration,
+		formatTimestamp(slot.Start),
+		formatTimestamp(slot.End),
+		seriesID,
+		formatTimestamp(now()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := slotResponse.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if id < 1 {
+		return 0, errors.New("something went wrong")
+	}
+	for _, user := range users {
+		if _, err = tx.Exec(insertSlotAttendee, id, user); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// rescheduleSlot moves a booking to a new date/slot in a single transaction,
+// the booking is left untouched when the new slot is not available
+func rescheduleSlot(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	var rescheduleInput rescheduleSlotInput
+	err = json.Unmarshal(jsonData, &rescheduleInput)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	booking, err := scanScheduledSlot(db.QueryRow(getBookedSlot, rescheduleInput.BookingID))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "booking not found or already cancelled",
+		})
+		return
+	}
+	if len(rescheduleInput.SlotConfig.SlotDuration) == 0 && rescheduleInput.SlotConfig.DurationMinutes == 0 {
+		rescheduleInput.SlotConfig.DurationMinutes = booking.DurationMinutes
+	}
+
+	// the organizer goes first, date and slot are read in their time zone
+	// unless the caller gives their own
+	users := []int{booking.OrganizerID}
+	for _, attendee := range booking.Attendees {
+		if attendee != booking.OrganizerID {
+			users = append(users, attendee)
+		}
+	}
+
+	loc, err := requestLocation(db, rescheduleInput.TimeZone, booking.OrganizerID)
+	if errors.Is(err, errInvalidTimeZone) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get the organizer",
+		})
+		return
+	}
+
+	// Parse the date, in the time zone of the caller
+	layout := "2006-01-02"
+	t, err := time.ParseInLocation(layout, rescheduleInput.Date, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+		})
+		return
+	}
+	if isPastDate(t) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "date cannot be in the past",
+		})
+		return
+	}
+
+	if rescheduleInput.SlotConfig.Every < 15 || rescheduleInput.SlotConfig.Every > 60 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "minumum search interval is 15 mins and max is 60 minutes period",
+		})
+		return
+	}
+	if _, err = rescheduleInput.SlotConfig.minutes(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// the check and the move share a transaction holding the write lock
+	tx, err := db.Begin()
+	if isDatabaseBusy(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "the calendar is busy, try again",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// the booking being moved doesn't block its own new slot
+	slot, code, user, err := checkBookableSlot(tx, slotInput{
+		UserIDs:    users,
+		Date:       rescheduleInput.Date,
+		TimeZone:   rescheduleInput.TimeZone,
+		SlotConfig: rescheduleInput.SlotConfig,
+	}, users, t, rescheduleInput.Slot, booking.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status":  "error",
+			"message": "unable to check the slot",
+		})
+		return
+	}
+	if code == dailyCapReached || code == weeklyCapReached {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"code":    code,
+			"message": fmt.Sprintf("user %d has no room left for another meeting", user),
+		})
+		return
+	}
+	if code != "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "slot unavailable",
+		})
+		return
+	}
+
+	// end minute is stored inclusive, e.g. 10:00 - 10:59
+	slotEnd := slot.End.Add(-time.Minute)
+	duration, _ := rescheduleInput.SlotConfig.minutes()
+	res, err := tx.Exec(rescheduleBookedSlot,
+		slot.Start.Format(layout),
+		slot.Start.Hour(),
+		slot.Start.Minute(),
+		slotEnd.Hour(),
+		slotEnd.Minute(),
+		duration,
+		formatTimestamp(slot.Start),
+		formatTimestamp(slot.End),
+		formatTimestamp(now()),
+		booking.ID,
+	)
+	if isBookingOverlap(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "slot unavailable",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to reschedule the slot",
+		})
+		return
+	}
+	if moved, err := res.RowsAffected(); err != nil || moved < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "booking not found or already cancelled",
+		})
+		return
+	}
+	err = tx.Commit()
+	if isDatabaseBusy(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"status":  "error",
+			"message": "the calendar is busy, try again",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to reschedule the slot",
+		})
+		return
+	}
+
+	notifyBookingWebhooks(db, webhookBookingRescheduled, []int64{int64(booking.ID)}, gin.H{
+		"previous_starts_at": booking.StartsAt,
+		"previous_ends_at":   booking.EndsAt,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"id":        booking.ID,
+		"starts_at": formatTimestamp(slot.Start),
+		"ends_at":   formatTimestamp(slot.End),
+	})
+}
+
+// cancelSlot cancels a booked slot for all of its users, or the upcoming
+// occurrences of its series. Rows are kept along with the reason and time of
+// cancellation
+func cancelSlot(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	var cancelInput cancelSlotInput
+	err = json.Unmarshal(jsonData, &cancelInput)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	cancelledAt := formatTimestamp(now())
+	if cancelInput.Series {
+		booking, err := scanScheduledSlot(db.QueryRow(getBookedSlot, cancelInput.BookingID))
+		if err != nil || booking.SeriesID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "booking not found, already cancelled or not part of a series",
+			})
+			return
+		}
+		rows, err := db.Query(cancelBookingSeries, cancelledAt, cancelInput.Reason, booking.SeriesID, cancelledAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to cancel the series",
+			})
+			return
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err = rows.Scan(&id); err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+		notifyBookingWebhooks(db, webhookBookingCancelled, ids, gin.H{"reason": cancelInput.Reason})
+		mailBookings(db, "CANCEL", ids)
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":       "success",
+			"series_id":    booking.SeriesID,
+			"cancelled":    len(ids),
+			"cancelled_at": cancelledAt,
+		})
+		return
+	}
+
+	res, err := db.Exec(cancelBookedSlot, cancelledAt, cancelInput.Reason, cancelInput.BookingID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to cancel the slot",
+		})
+		return
+	}
+	var cancelled int64
+	if cancelled, err = res.RowsAffected(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if cancelled < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "booking not found or already cancelled",
+		})
+		return
+	}
+
+	notifyBookingWebhooks(db, webhookBookingCancelled, []int64{int64(cancelInput.BookingID)}, gin.H{"reason": cancelInput.Reason})
+	mailBookings(db, "CANCEL", []int64{int64(cancelInput.BookingID)})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "success",
+		"id":           cancelInput.BookingID,
+		"cancelled_at": cancelledAt,
+	})
+}
+
+// uploadExternalCalendar stores an uploaded iCalendar file (multipart field
+// file, along with user_id) whose events count as busy time for the user
+func uploadExternalCalendar(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxCalendarSize)
+	userID, err := strconv.Atoi(c.PostForm("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid user id",
+		})
+		return
+	}
+	upload, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "kindly upload the .ics file in the file field",
+		})
+		return
+	}
+	f, err := upload.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to read the file",
+		})
+		return
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to read the file",
+		})
+		return
+	}
+	storeExternalCalendar(c, userID, nil, string(content))
+}
+
+// setExternalCalendar registers a local iCalendar file whose events count as
+// busy time for the user, the file is read again on every lookup
+func setExternalCalendar(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var calendar externalCalendarInput
+	err = json.Unmarshal(jsonData, &calendar)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	if calendarImportDir == "" {
+		c.JSON(http.StatusForbidden, gin.H{
+			"status":  "error",
+			"message": "local files can't be registered, ICS_IMPORT_DIR is not set",
+		})
+		return
+	}
+	path := filepath.Clean(calendar.Path)
+	resolved, err := importablePath(path)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	content, err := os.ReadFile(resolved)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to read the file",
+		})
+		return
+	}
+	storeExternalCalendar(c, calendar.UserID, path, string(content))
+}
+
+// importablePath resolves the symbolic links of path and checks the file it
+// points to is within calendarImportDir, which has to be set
+func importablePath(path string) (string, error) {
+	if calendarImportDir == "" {
+		return "", errors.New("ICS_IMPORT_DIR is not set")
+	}
+	if !filepath.IsAbs(path) {
+		return "", errors.New("path has to be absolute")
+	}
+	dir, err := filepath.Abs(calendarImportDir)
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return "", errors.New("unable to read the import directory")
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", errors.New("unable to read the file")
+	}
+	if !strings.HasPrefix(resolved, dir+string(filepath.Separator)) {
+		return "", errors.New("path has to be within the import directory")
+	}
+	return resolved, nil
+}
+
+// storeExternalCalendar checks content is an iCalendar object and stores
+// either path or, when path is nil, the content itself
+func storeExternalCalendar(c *gin.Context, userID int, path any, content string) {
+	events, err := parseICSEvents(content, time.UTC)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	var stored any = content
+	if path != nil {
+		stored = nil
+	}
+	res, err := db.Exec(insertExternalCalendar, userID, path, stored)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to store the calendar",
+		})
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"calendar_id": id,
+		"events":      len(events),
+	})
+}
+
+// deleteExternalCalendar drops an uploaded or registered calendar
+func deleteExternalCalendar(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var calendar deleteExternalCalendarInput
+	err = json.Unmarshal(jsonData, &calendar)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	res, err := db.Exec(deleteUserExternalCalendar, calendar.CalendarID, calendar.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to delete the calendar",
+		})
+		return
+	}
+	if deleted, err := res.RowsAffected(); err != nil || deleted < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "calendar not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// exportCalendar serves the bookings of a user as an RFC 5545 iCalendar feed,
+// one VEVENT per booked slot (cancelled ones included) that calendar clients
+// can subscribe to
+func exportCalendar(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid user id",
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	var name string
+	if err = db.QueryRow(getUserName, userID).Scan(&name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "error",
+			"message": "user not found",
+		})
+		return
+	}
+	objects, err := getCalDAVObjects(db, userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get booked slots",
+		})
+		return
+	}
+
+	rows, err := db.Query(getUserAllBookedSlots, userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get booked slots",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var calendar strings.Builder
+	writeICSLine(&calendar, "BEGIN:VCALENDAR")
+	writeICSLine(&calendar, "VERSION:2.0")
+	writeICSLine(&calendar, "PRODID:-//calenderapi//bookings//EN")
+	writeICSLine(&calendar, "CALSCALE:GREGORIAN")
+	writeICSLine(&calendar, "METHOD:PUBLISH")
+	writeICSLine(&calendar, "X-WR-CALNAME:"+escapeICSText(name))
+	userContact := userContacts(db)
+	for rows.Next() {
+		slot, err := scanScheduledSlot(rows)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to get booked slots",
+			})
+			return
+		}
+		writeBookingEvent(&calendar, slot, objects[slot.ID].UID, userID, userContact)
+	}
+	writeICSLine(&calendar, "END:VCALENDAR")
+
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=\"user-%d.ics\"", userID))
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(calendar.String()))
+}
+
+// freeBusy returns the merged busy intervals of several users over a time
+// range, without telling what the meetings are. Time is busy when it's
+// booked, outside of the user's availability or busy in one of their
+// external calendars
+func freeBusy(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	var freeBusyQuery freeBusyInput
+	err = json.Unmarshal(jsonData, &freeBusyQuery)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	users := freeBusyQuery.UserIDs
+	if len(users) < 1 || len(users) > maxParticipants {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("free/busy can be looked up for between 1 and %d users", maxParticipants),
+		})
+		return
+	}
+	seen := make(map[int]bool)
+	for _, user := range users {
+		if seen[user] {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "a user cannot be listed more than once",
+			})
+			return
+		}
+		seen[user] = true
+	}
+	if freeBusyQuery.Format != "" && freeBusyQuery.Format != "json" && freeBusyQuery.Format != "ics" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "format has to be json or ics",
+		})
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, freeBusyQuery.From)
+	to, toErr := time.Parse(time.RFC3339, freeBusyQuery.To)
+	if err != nil || toErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid from or to, kindly format them as RFC 3339 timestamps, e.g. 2024-07-15T09:00:00Z",
+		})
+		return
+	}
+	window := timeRange{Start: from, End: to}
+	if !window.Start.Before(window.End) || window.End.After(window.Start.AddDate(0, 0, maxSearchDays)) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("to has to be after from and the range cannot exceed %d days", maxSearchDays),
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	busy := make(map[int][]timeRange)
+	for _, user := range users {
+		if _, err = getUserLocation(db, user); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("user %d not found", user),
+			})
+			return
+		}
+		if busy[user], err = getUserBusy(db, user, window); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to get the busy time",
+			})
+			return
+		}
+	}
+
+	if freeBusyQuery.Format == "ics" {
+		userContact := userContacts(db)
+		var calendar strings.Builder
+		writeICSLine(&calendar, "BEGIN:VCALENDAR")
+		writeICSLine(&calendar, "VERSION:2.0")
+		writeICSLine(&calendar, "PRODID:-//calenderapi//bookings//EN")
+		writeICSLine(&calendar, "METHOD:PUBLISH")
+		for _, user := range users {
+			writeICSLine(&calendar, "BEGIN:VFREEBUSY")
+			writeICSLine(&calendar, fmt.Sprintf("UID:freebusy-%d-%s@calenderapi", user, formatICSTime(window.Start)))
+			writeICSLine(&calendar, "DTSTAMP:"+formatICSTime(now()))
+			writeICSLine(&calendar, "DTSTART:"+formatICSTime(window.Start))
+			writeICSLine(&calendar, "DTEND:"+formatICSTime(window.End))
+			organizer := userContact(user)
+			writeICSLine(&calendar, fmt.Sprintf("ORGANIZER;CN=%s:%s", quoteICSParam(organizer.Name), organizer.address()))
+			for _, r := range busy[user] {
+				writeICSLine(&calendar, fmt.Sprintf("FREEBUSY;FBTYPE=BUSY:%s/%s", formatICSTime(r.Start), formatICSTime(r.End)))
+			}
+			writeICSLine(&calendar, "END:VFREEBUSY")
+		}
+		writeICSLine(&calendar, "END:VCALENDAR")
+		c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(calendar.String()))
+		return
+	}
+
+	freeBusyUsers := []gin.H{}
+	for _, user := range users {
+		periods := []gin.H{}
+		for _, r := range busy[user] {
+			periods = append(periods, gin.H{
+				"start": formatTimestamp(r.Start),
+				"end":   formatTimestamp(r.End),
+			})
+		}
+		freeBusyUsers = append(freeBusyUsers, gin.H{
+			"user_id": user,
+			"busy":    periods,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"from":  formatTimestamp(window.Start),
+		"to":    formatTimestamp(window.End),
+		"users": freeBusyUsers,
+	})
+}
+
+// getUserBusy merges the bookings of user within window with the time outside
+// of their availability and the busy time of their external calendars
+func getUserBusy(q querier, user int, window timeRange) ([]timeRange, error) {
+	windows, err := getUserWindows(q, user, window.Start, window.End)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	// the gaps between availability windows are busy
+	var busy []timeRange
+	free := window.Start
+	for _, r := range windows {
+		if free.Before(r.Start) {
+			busy = append(busy, timeRange{Start: free, End: r.Start})
+		}
+		if r.End.After(free) {
+			free = r.End
+		}
+	}
+	if free.Before(window.End) {
+		busy = append(busy, timeRange{Start: free, End: window.End})
+	}
+
+	rows, err := q.Query(getUserBookedSlots, user, formatTimestamp(window.End), formatTimestamp(window.Start), 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		slot, err := scanScheduledSlot(rows)
+		if err != nil {
+			return nil, err
+		}
+		if booked, err := slot.timeRange(); err == nil {
+			busy = append(busy, booked)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	external, err := getUserExternalBusy(q, user, window.Start, window.End)
+	if err != nil {
+		return nil, err
+	}
+	return mergeTimeRanges(append(busy, external...), window), nil
+}
+
+// webhook events
+const (
+	webhookBookingCreated      = "booking.created"
+	webhookBookingRescheduled  = "booking.rescheduled"
+	webhookBookingCancelled    = "booking.cancelled"
+	webhookAvailabilityChanged = "availability.changed"
+	webhookBookingReminder     = "booking.reminder"
+)
+
+var webhookEvents = []string{webhookBookingCreated, webhookBookingRescheduled, webhookBookingCancelled, webhookAvailabilityChanged, webhookBookingReminder}
+
+// webhookMaxAttempts caps the deliveries of an event to a webhook, the n-th
+// retry waits webhookRetryDelay * 2^(n-1)
+const webhookMaxAttempts = 5
+
+var webhookRetryDelay = time.Second
+
+// webhookAllowPrivate lets webhooks reach loopback, link-local and private
+// addresses, which would otherwise let whoever registers a webhook send
+// requests to internal hosts. WEBHOOK_ALLOW_PRIVATE=true turns it on, e.g.
+// for a receiver running next to the service
+var webhookAllowPrivate = false
+
+var errWebhookAddress = errors.New("webhooks can't reach loopback, link-local or private addresses")
+
+// webhookAddressAllowed reports whether webhooks can be delivered to ip
+func webhookAddressAllowed(ip net.IP) bool {
+	if webhookAllowPrivate {
+		return true
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// webhookClient delivers webhooks without a proxy, every connection it
+// makes, redirects included, is checked once the host name is resolved so
+// that a name can't be pointed at an internal address after the webhook
+// was registered
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+					return errWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// validateWebhookURL checks url is an absolute http or https url whose host
+// resolves to addresses webhooks can reach
+func validateWebhookURL(rawURL string) error {
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return errors.New("url has to be an absolute http or https url")
+	}
+	ips := []net.IP{net.ParseIP(target.Hostname())}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(target.Hostname()); err != nil {
+			return fmt.Errorf("unable to resolve %s", target.Hostname())
+		}
+	}
+	for _, ip := range ips {
+		if !webhookAddressAllowed(ip) {
+			return errWebhookAddress
+		}
+	}
+	return nil
+}
+
+// webhookDeliveries tracks the deliveries in flight
+var webhookDeliveries sync.WaitGroup
+
+// webhook is a registered receiver of events
+type webhook struct {
+	ID     int
+	URL    string
+	Secret string
+	Events string
+}
+
+// subscribes reports whether the webhook wants event
+func (hook webhook) subscribes(event string) bool {
+	return hook.Events == "" || slices.Contains(strings.Split(hook.Events, ","), event)
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// signWebhook is the hex encoded HMAC-SHA256 of payload
+func signWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setWebhook registers a webhook, the secret signing its deliveries is only
+// ever returned here
+func setWebhook(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var hook webhookInput
+	err = json.Unmarshal(jsonData, &hook)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	if err = validateWebhookURL(hook.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	for _, event := range hook.Events {
+		if !slices.Contains(webhookEvents, event) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("unknown event %q, kindly use %s", event, strings.Join(webhookEvents, ", ")),
+			})
+			return
+		}
+	}
+	if hook.Secret == "" {
+		hook.Secret = randomHex(32)
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	res, err := db.Exec(insertWebhook, hook.URL, hook.Secret, strings.Join(hook.Events, ","))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to register the webhook",
+		})
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"id":     id,
+		"secret": hook.Secret,
+	})
+}
+
+// deleteWebhook drops a webhook along with its delivery log
+func deleteWebhook(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+	var hook deleteWebhookInput
+	err = json.Unmarshal(jsonData, &hook)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request payload",
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	var res sql.Result
+	_, err = tx.Exec(deleteWebhookDeliveries, hook.WebhookID)
+	if err == nil {
+		res, err = tx.Exec(deleteCalendarWebhook, hook.WebhookID)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to delete the webhook",
+		})
+		return
+	}
+	if deleted, err := res.RowsAffected(); err != nil || deleted < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "webhook not found",
+		})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to delete the webhook",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// listWebhookDeliveries returns the latest delivery attempts of a webhook
+func listWebhookDeliveries(c *gin.Context) {
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid webhook id",
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "internal error",
+		})
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(getWebhookDeliveries, webhookID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get the deliveries",
+		})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []webhookDelivery{}
+	for rows.Next() {
+		var delivery webhookDelivery
+		var payload string
+		if err = rows.Scan(&delivery.ID, &delivery.EventID, &delivery.Event, &payload, &delivery.Attempt, &delivery.StatusCode, &delivery.Error, &delivery.CreatedAt); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "unable to get the deliveries",
+			})
+			return
+		}
+		delivery.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, delivery)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"webhook_id": webhookID,
+		"deliveries": deliveries,
+	})
+}
+
+// notifyWebhooks sends event to every webhook subscribing to it. Deliveries
+// run in the background, see deliverWebhook
+func notifyWebhooks(event string, data any) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		log.Printf("webhooks: unable to send %s: %v", event, err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(getWebhooks)
+	if err != nil {
+		log.Printf("webhooks: unable to send %s, reading the webhooks failed: %v", event, err)
+		return
+	}
+	defer rows.Close()
+
+	var hooks []webhook
+	for rows.Next() {
+		var hook webhook
+		if err = rows.Scan(&hook.ID, &hook.URL, &hook.Secret, &hook.Events); err != nil {
+			log.Printf("webhooks: unable to send %s, reading the webhooks failed: %v", event, err)
+			return
+		}
+		if hook.subscribes(event) {
+			hooks = append(hooks, hook)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("webhooks: unable to send %s, reading the webhooks failed: %v", event, err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	eventID := "evt_" + randomHex(12)
+	payload, err := json.Marshal(gin.H{
+		"id":         eventID,
+		"event":      event,
+		"created_at": formatTimestamp(now()),
+		"data":       data,
+	})
+	if err != nil {
+		log.Printf("webhooks: unable to encode %s: %v", event, err)
+		return
+	}
+	for _, hook := range hooks {
+		webhookDeliveries.Add(1)
+		go func(hook webhook) {
+			defer webhookDeliveries.Done()
+			deliverWebhook(hook, eventID, event, payload)
+		}(hook)
+	}
+}
+
+// deliverWebhook POSTs payload to the webhook, signed in the
+// X-Webhook-Signature header as sha256=<hex HMAC-SHA256 of the body>. Failed
+// attempts, a transport error or a non 2xx response, are retried with an
+// exponential backoff and every attempt is logged
+func deliverWebhook(hook webhook, eventID string, event string, payload []byte) {
+	signature := "sha256=" + signWebhook(hook.Secret, payload)
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		statusCode, err := postWebhook(hook.URL, eventID, event, signature, payload)
+		if err == nil && (statusCode < 200 || statusCode > 299) {
+			err = fmt.Errorf("unexpected status %d", statusCode)
+		}
+		errMessage := ""
+		if err != nil {
+			errMessage = err.Error()
+		}
+		if logErr := logWebhookDelivery(hook.ID, eventID, event, payload, attempt, statusCode, errMessage); logErr != nil {
+			log.Printf("webhook %d: unable to log attempt %d of %s: %v", hook.ID, attempt, eventID, logErr)
+		}
+		if err == nil {
+			return
+		}
+		if attempt < webhookMaxAttempts {
+			time.Sleep(webhookRetryDelay << (attempt - 1))
+		} else {
+			log.Printf("webhook %d: gave up on %s (%s) after %d attempts: %v", hook.ID, eventID, event, attempt, err)
+		}
+	}
+}
+
+func postWebhook(target string, eventID string, event string, signature string, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-ID", eventID)
+	req.Header.Set("X-Webhook-Signature", signature)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func logWebhookDelivery(webhookID int, eventID string, event string, payload []byte, attempt int, statusCode int, errMessage string) error {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(insertWebhookDelivery, webhookID, eventID, event, string(payload), attempt, statusCode, errMessage)
+	return err
+}
+
+// notifyBookingWebhooks sends event for each of the bookings as they are now,
+// along with extra
+func notifyBookingWebhooks(q querier, event string, ids []int64, extra gin.H) {
+	for _, id := range ids {
+		slot, err := scanScheduledSlot(q.QueryRow(getBookedSlotWithCancelled, id))
+		if err != nil {
+			log.Printf("webhooks: unable to send %s of booking %d: %v", event, id, err)
+			continue
+		}
+		data := gin.H{"booking": slot}
+		for key, value := range extra {
+			data[key] = value
+		}
+		notifyWebhooks(event, data)
+	}
+}
+
+// SMTP settings, read from SMTP_HOST, SMTP_PORT, SMTP_USERNAME,
+// SMTP_PASSWORD and SMTP_FROM. Emails are only sent when SMTP_HOST is set
+var smtpAddr = ""
+var smtpAuth smtp.Auth
+var smtpFrom = "calendar@localhost"
+
+// sendMail hands a message to the SMTP server, tests can swap it for an
+// in-process fake
+var sendMail = smtp.SendMail
+
+// mailDeliveries tracks the emails being sent
+var mailDeliveries sync.WaitGroup
+
+// contact is how a user is addressed in emails
+type contact struct {
+	ID       int
+	Name     string
+	Email    string
+	Location *time.Location
+}
+
+// address is the calendar address of the contact, their email when known
+func (to contact) address() string {
+	if to.Email == "" {
+		return userCalAddress(to.ID)
+	}
+	return "mailto:" + to.Email
+}
+
+// validEmail accepts a bare address such as jane@example.com, or nothing
+func validEmail(email string) bool {
+	if email == "" {
+		return true
+	}
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+func seriesUID(id int) string {
+	return fmt.Sprintf("series-%d@calenderapi", id)
+}
+
+// mailBookings emails an iTIP invite (method REQUEST) or cancellation
+// (method CANCEL) to every participant having an email. ids are a single
+// booking or occurrences of the same series, which are sent as one event
+// whose occurrences are listed as RDATEs
+func mailBookings(q querier, method string, ids []int64) {
+	if smtpAddr == "" || len(ids) == 0 {
+		return
+	}
+	var slots []scheduledSlot
+	for _, id := range ids {
+		slot, err := scanScheduledSlot(q.QueryRow(getBookedSlotWithCancelled, id))
+		if err != nil {
+			log.Printf("mail: unable to send %s of booking %d: %v", method, id, err)
+			continue
+		}
+		slots = append(slots, slot)
+	}
+	if len(slots) == 0 {
+		return
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].StartsAt < slots[j].StartsAt
+	})
+
+	uid := seriesUID(slots[0].SeriesID)
+	if slots[0].SeriesID == 0 {
+		objects, err := getCalDAVObjects(q, slots[0].OrganizerID)
+		if err != nil {
+			log.Printf("mail: unable to send %s of booking %d: %v", method, slots[0].ID, err)
+			return
+		}
+		uid = calendarObjectOf(objects, slots[0].ID).UID
+	}
+	contacts, err := getContacts(q, slots[0].Attendees)
+	if err != nil {
+		log.Printf("mail: unable to send %s of booking %d, reading the participants failed: %v", method, slots[0].ID, err)
+		return
+	}
+
+	for _, to := range contacts {
+		if to.Email == "" {
+			continue
+		}
+		message, err := inviteMail(method, uid, slots, contacts, to)
+		if err != nil {
+			log.Printf("mail: unable to write %s of booking %d to user %d: %v", method, slots[0].ID, to.ID, err)
+			continue
+		}
+		deliverMail(to, message)
+	}
+}
+
+// getContacts reads how each of the users is addressed in emails
+func getContacts(q querier, users []int) (map[int]contact, error) {
+	contacts := make(map[int]contact)
+	for _, user := range users {
+		to := contact{ID: user}
+		var timeZone string
+		if err := q.QueryRow(getUserContact, user).Scan(&to.Name, &to.Email, &timeZone); err != nil {
+			return nil, err
+		}
+		if loc, err := time.LoadLocation(timeZone); err == nil {
+			to.Location = loc
+		} else {
+			to.Location = time.UTC
+		}
+		contacts[user] = to
+	}
+	return contacts, nil
+}
+
+// deliverMail sends message to the contact in the background
+func deliverMail(to contact, message []byte) {
+	envelopeFrom, err := mail.ParseAddress(smtpFrom)
+	if err != nil {
+		log.Printf("mail: unable to email user %d, invalid SMTP_FROM %q: %v", to.ID, smtpFrom, err)
+		return
+	}
+	mailDeliveries.Add(1)
+	go func() {
+		defer mailDeliveries.Done()
+		if err := sendMail(smtpAddr, smtpAuth, envelopeFrom.Address, []string{to.Email}, message); err != nil {
+			log.Printf("mail: unable to email user %d at %s: %v", to.ID, to.Email, err)
+		}
+	}()
+}
+
+// writeMailHeaders writes the headers of an email to the contact
+func writeMailHeaders(message *bytes.Buffer, to contact, subject string, contentType string) {
+	fmt.Fprintf(message, "From: %s\r\n", smtpFrom)
+	fmt.Fprintf(message, "To: %s\r\n", (&mail.Address{Name: to.Name, Address: to.Email}).String())
+	fmt.Fprintf(message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(message, "Date: %s\r\n", now().Format(time.RFC1123Z))
+	fmt.Fprintf(message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(message, "Content-Type: %s\r\n", contentType)
+}
+
+// inviteMail builds the email of an invite or cancellation to a participant,
+// a plain text summary in their time zone along with the invite.ics
+func inviteMail(method string, uid string, slots []scheduledSlot, contacts map[int]contact, to contact) ([]byte, error) {
+	organizer := contacts[slots[0].OrganizerID]
+	var others []string
+	for _, user := range slots[0].Attendees {
+		if user != to.ID {
+			others = append(others, contacts[user].Name)
+		}
+	}
+	summary := "Meeting with " + strings.Join(others, ", ")
+
+	var when []string
+	var ranges []timeRange
+	for _, slot := range slots {
+		booked, err := slot.timeRange()
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, booked)
+		start, end := booked.Start.In(to.Location), booked.End.In(to.Location)
+		when = append(when, fmt.Sprintf("%s - %s (%s)", start.Format("Monday 2 January 2006, 15:04"), end.Format("15:04"), to.Location))
+	}
+
+	var calendar strings.Builder
+	writeICSLine(&calendar, "BEGIN:VCALENDAR")
+	writeICSLine(&calendar, "VERSION:2.0")
+	writeICSLine(&calendar, "PRODID:-//calenderapi//bookings//EN")
+	writeICSLine(&calendar, "METHOD:"+method)
+	writeEvent := func(sequence int, status string, booked timeRange, recurrenceID bool, rdates []timeRange) {
+		writeICSLine(&calendar, "BEGIN:VEVENT")
+		writeICSLine(&calendar, "UID:"+uid)
+		writeICSLine(&calendar, fmt.Sprintf("SEQUENCE:%d", sequence))
+		writeICSLine(&calendar, "DTSTAMP:"+formatICSTime(now()))
+		if recurrenceID {
+			writeICSLine(&calendar, "RECURRENCE-ID:"+formatICSTime(booked.Start))
+		}
+		writeICSLine(&calendar, "DTSTART:"+formatICSTime(booked.Start))
+		writeICSLine(&calendar, "DTEND:"+formatICSTime(booked.End))
+		if len(rdates) > 0 {
+			var dates []string
+			for _, r := range rdates {
+				dates = append(dates, formatICSTime(r.Start))
+			}
+			writeICSLine(&calendar, "RDATE:"+strings.Join(dates, ","))
+		}
+		writeICSLine(&calendar, "SUMMARY:"+escapeICSText(summary))
+		writeICSLine(&calendar, fmt.Sprintf("ORGANIZER;CN=%s:%s", quoteICSParam(organizer.Name), organizer.address()))
+		for _, user := range slots[0].Attendees {
+			if user != organizer.ID {
+				writeICSLine(&calendar, fmt.Sprintf("ATTENDEE;CN=%s;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=FALSE:%s", quoteICSParam(contacts[user].Name), contacts[user].address()))
+			}
+		}
+		writeICSLine(&calendar, "STATUS:"+status)
+		writeICSLine(&calendar, "END:VEVENT")
+	}
+
+	var subject, text string
+	if method == "CANCEL" {
+		// each occurrence of a series is cancelled on its own
+		for _, booked := range ranges {
+			writeEvent(1, "CANCELLED", booked, slots[0].SeriesID != 0, nil)
+		}
+		subject = "Cancelled: " + summary
+		text = fmt.Sprintf("The meeting with %s has been cancelled.\r\n\r\n", strings.Join(others, ", "))
+	} else {
+		writeEvent(0, "CONFIRMED", ranges[0], false, ranges[1:])
+		subject = "Invitation: " + summary
+		text = fmt.Sprintf("%s invited you to a meeting with %s.\r\n\r\n", organizer.Name, strings.Join(others, ", "))
+		if organizer.ID == to.ID {
+			text = fmt.Sprintf("You booked a meeting with %s.\r\n\r\n", strings.Join(others, ", "))
+		}
+	}
+	writeICSLine(&calendar, "END:VCALENDAR")
+	subject += ", " + strings.SplitN(when[0], ",", 2)[0]
+	text += "When:\r\n" + strings.Join(when, "\r\n") + "\r\n"
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := parts.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	textWriter := quotedprintable.NewWriter(part)
+	if _, err = textWriter.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err = textWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Type", fmt.Sprintf("text/calendar; charset=utf-8; method=%s", method))
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", `attachment; filename="invite.ics"`)
+	if part, err = parts.CreatePart(header); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(calendar.String()))
+	for len(encoded) > 76 {
+		io.WriteString(part, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(part, encoded+"\r\n")
+	if err = parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	writeMailHeaders(&message, to, subject, fmt.Sprintf("multipart/mixed; boundary=%q", parts.Boundary()))
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// reminder settings, REMINDER_OFFSETS lists how long before a booking its
+// reminders are sent (e.g. 24h,15m, "none" to turn them off) and
+// REMINDER_INTERVAL how often the worker looks for due reminders
+var reminderOffsets = []time.Duration{15 * time.Minute, 24 * time.Hour}
+var reminderInterval = time.Minute
+
+// parseReminderOffsets reads a comma separated list of whole minute
+// durations, sorted from the closest to the start of a booking
+func parseReminderOffsets(value string) ([]time.Duration, error) {
+	if value == "none" {
+		return nil, nil
+	}
+	var offsets []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		offset, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || offset < time.Minute || offset%time.Minute != 0 {
+			return nil, fmt.Errorf("invalid reminder offset %q, kindly use whole minutes such as 24h or 15m", part)
+		}
+		if !slices.Contains(offsets, offset) {
+			offsets = append(offsets, offset)
+		}
+	}
+	slices.Sort(offsets)
+	return offsets, nil
+}
+
+// runReminders sends due reminders every reminderInterval, it never returns
+func runReminders() {
+	for {
+		if err := sendDueReminders(); err != nil {
+			log.Printf("reminders: unable to send the due reminders: %v", err)
+		}
+		time.Sleep(reminderInterval)
+	}
+}
+
+// sendDueReminders sends the reminders due at now() to the booking.reminder
+// webhooks and, by email, to the participants. Only the closest due offset
+// of a booking is sent: a booking made 10 minutes ahead gets a single
+// reminder rather than its 24h and 15m ones at once. Reminders are recorded
+// before being sent so that none is sent twice, even across restarts, and a
+// rescheduled booking gets its reminders again
+func sendDueReminders() error {
+	if len(reminderOffsets) == 0 {
+		return nil
+	}
+	at := now()
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(getUpcomingBookedSlots, formatTimestamp(at), formatTimestamp(at.Add(reminderOffsets[len(reminderOffsets)-1])))
+	if err != nil {
+		return err
+	}
+	var slots []scheduledSlot
+	for rows.Next() {
+		slot, err := scanScheduledSlot(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		slots = append(slots, slot)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// a booking failing is logged so that it doesn't hold up the others
+	for _, slot := range slots {
+		booked, err := slot.timeRange()
+		if err != nil {
+			log.Printf("reminders: booking %d left out: %v", slot.ID, err)
+			continue
+		}
+		var due []time.Duration
+		for _, offset := range reminderOffsets {
+			if !at.Before(booked.Start.Add(-offset)) {
+				due = append(due, offset)
+			}
+		}
+		if len(due) == 0 {
+			continue
+		}
+		claimed, err := claimReminder(db, slot, due)
+		if err != nil {
+			log.Printf("reminders: unable to record the reminder of booking %d: %v", slot.ID, err)
+			continue
+		}
+		if claimed {
+			sendReminder(db, slot, booked, due[0], at)
+		}
+	}
+	return nil
+}
+
+// claimReminder records the due reminders of a booking, the closest one as
+// sent and the others as skipped. It reports false when the closest one was
+// already recorded
+func claimReminder(db *sql.DB, slot scheduledSlot, due []time.Duration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(insertBookingReminder, slot.ID, slot.StartsAt, int(due[0]/time.Minute), false)
+	if err != nil {
+		return false, err
+	}
+	if claimed, err := res.RowsAffected(); err != nil || claimed < 1 {
+		return false, err
+	}
+	for _, offset := range due[1:] {
+		if _, err = tx.Exec(insertBookingReminder, slot.ID, slot.StartsAt, int(offset/time.Minute), true); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// sendReminder notifies the booking.reminder webhooks and emails the
+// participants of a booking starting soon
+func sendReminder(q querier, slot scheduledSlot, booked timeRange, offset time.Duration, at time.Time) {
+	startsIn := booked.Start.Sub(at).Round(time.Minute)
+	notifyWebhooks(webhookBookingReminder, gin.H{
+		"booking":           slot,
+		"offset_minutes":    int(offset / time.Minute),
+		"starts_in_minutes": int(startsIn / time.Minute),
+	})
+	if smtpAddr == "" {
+		return
+	}
+
+	contacts, err := getContacts(q, slot.Attendees)
+	if err != nil {
+		log.Printf("reminders: unable to email the reminder of booking %d, reading the participants failed: %v", slot.ID, err)
+		return
+	}
+	for _, to := range contacts {
+		if to.Email == "" {
+			continue
+		}
+		var others []string
+		for _, user := range slot.Attendees {
+			if user != to.ID {
+				others = append(others, contacts[user].Name)
+			}
+		}
+		start, end := booked.Start.In(to.Location), booked.End.In(to.Location)
+		subject := fmt.Sprintf("Reminder: Meeting with %s at %s", strings.Join(others, ", "), start.Format("15:04"))
+		text := fmt.Sprintf("Your meeting with %s starts in %s.\r\n\r\nWhen:\r\n%s - %s (%s)\r\n",
+			strings.Join(others, ", "), startsIn, start.Format("Monday 2 January 2006, 15:04"), end.Format("15:04"), to.Location)
+
+		var message bytes.Buffer
+		writeMailHeaders(&message, to, subject, "text/plain; charset=utf-8")
+		message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		textWriter := quotedprintable.NewWriter(&message)
+		textWriter.Write([]byte(text))
+		textWriter.Close()
+		deliverMail(to, message.Bytes())
+	}
+}
+
+// userContacts returns a lookup of how users are named and addressed in
+// calendars, caching the ones already read
+func userContacts(q querier) func(int) contact {
+	contacts := make(map[int]contact)
+	return func(user int) contact {
+		if _, ok := contacts[user]; !ok {
+			found, err := getContacts(q, []int{user})
+			if err != nil {
+				found = map[int]contact{user: {ID: user, Name: fmt.Sprintf("user %d", user), Location: time.UTC}}
+			}
+			contacts[user] = found[user]
+		}
+		return contacts[user]
+	}
+}
+
+// writeBookingEvent writes a booked slot as a VEVENT of the calendar of user,
+// summarized as a meeting with the other participants. uid defaults to the
+// booking's own, the event is stamped with the booking's last change
+func writeBookingEvent(calendar *strings.Builder, slot scheduledSlot, uid string, user int, userContact func(int) contact) {
+	booked, err := slot.timeRange()
+	if err != nil {
+		return
+	}
+	if uid == "" {
+		uid = bookingUID(slot.ID)
+	}
+
+	var others []string
+	for _, attendee := range slot.Attendees {
+		if attendee != user {
+			others = append(others, userContact(attendee).Name)
+		}
+	}
+	writeICSLine(calendar, "BEGIN:VEVENT")
+	writeICSLine(calendar, "UID:"+uid)
+	stamp, err := time.Parse(time.RFC3339, slot.updatedAt)
+	if err != nil {
+		stamp = now()
+	}
+	writeICSLine(calendar, "DTSTAMP:"+formatICSTime(stamp))
+	writeICSLine(calendar, "DTSTART:"+formatICSTime(booked.Start))
+	writeICSLine(calendar, "DTEND:"+formatICSTime(booked.End))
+	writeICSLine(calendar, "SUMMARY:"+escapeICSText("Meeting with "+strings.Join(others, ", ")))
+	organizer := userContact(slot.OrganizerID)
+	writeICSLine(calendar, fmt.Sprintf("ORGANIZER;CN=%s:%s", quoteICSParam(organizer.Name), organizer.address()))
+	for _, attendee := range slot.Attendees {
+		if attendee != user {
+			to := userContact(attendee)
+			writeICSLine(calendar, fmt.Sprintf("ATTENDEE;CN=%s;ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED:%s", quoteICSParam(to.Name), to.address()))
+		}
+	}
+	if slot.CancelledAt != "" {
+		writeICSLine(calendar, "STATUS:CANCELLED")
+	} else {
+		writeICSLine(calendar, "STATUS:CONFIRMED")
+	}
+	writeICSLine(calendar, "END:VEVENT")
+}
+
+// findAvailableSlots invokes
+// build in function to identify calendar diff for
+// all the users
+// returns slot's that are available on a given day
+// considering the already booked slots
+func findAvailableSlots(c *gin.Context) {
+	jsonData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+	var findSlotInput findAvailableSlotInput
+	err = json.Unmarshal(jsonData, &findSlotInput)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid request body",
+		})
+		return
+	}
+
+	users, err := findSlotInput.participants()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	optional, err := findSlotInput.optionalAttendees(users)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "something went wrong",
+		})
+		return
+	}
+	defer db.Close()
+
+	loc, err := requestLocation(db, findSlotInput.TimeZone, users[0])
+	if errors.Is(err, errInvalidTimeZone) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unable to get the organizer",
+		})
+		return
+	}
+
+	if findSlotInput.SlotConfig.Every < 15 || findSlotInput.SlotConfig.Every > 60 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "minumum search interval is 15 mins and max is 60 minutes period",
+		})
+		return
+	}
+	if _, err = findSlotInput.SlotConfig.minutes(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// Parse the dates, in the time zone of the caller
+	layout := "2006-01-02"
+	if findSlotInput.From == "" && findSlotInput.Next == 0 {
+		t, err := time.ParseInLocation(layout, findSlotInput.Date, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "invalid date format, kindly format the date to yyyy-mm-dd format",
+			})
+			return
+		}
+		if isPastDate(t) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "date cannot be in the past",
+			})
+			return
+		}
+
+		day, err := findDateSlots(db, findSlotInput, users, optional, t, time.Time{})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "something went wrong",
+			})
+			return
+		}
+
+		response := gin.H{
+			"date":      findSlotInput.Date,
+			"time_zone": loc.String(),
+			"slots":     day.Slots,
+		}
+		if findSlotInput.LegacyFormat {
+			slots, optionalAvailable := legacySlots(day.Slots)
+			response["slots"] = slots
+			if len(optional) > 0 {
+				response["optional_available"] = optionalAvailable
+			}
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	// either a date range, or the next N slots from now
+	var from, to, notBefore time.Time
+	if findSlotInput.Next != 0 {
+		if findSlotInput.Next < 0 || findSlotInput.Next > maxNextSlots {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("next has to be between 1 and %d", maxNextSlots),
+			})
+			return
+		}
+		notBefore = now().In(loc)
+		from = time.Date(notBefore.Year(), notBefore.Month(), notBefore.Day(), 0, 0, 0, 0, loc)
+		to = from.AddDate(0, 0, maxSearchDays-1)
+	} else {
+		from, err = time.ParseInLocation(layout, findSlotInput.From, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "invalid from date format, kindly format the date to yyyy-mm-dd format",
+			})
+			return
+		}
+		if isPastDate(from) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "date cannot be in the past",
+			})
+			return
+		}
+		to, err = time.ParseInLocation(layout, findSlotInput.To, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "invalid to date format, kindly format the date to yyyy-mm-dd format",
+			})
+			return
+		}
+		if to.Before(from) || !to.Before(from.AddDate(0, 0, maxSearchDays)) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("to has to be on or after from and the range cannot exceed %d days", maxSearchDays),
+			})
+			return
+		}
+	}
+
+	dates := []dateSlots{}
+	found := 0
+	for t := from; !t.After(to); t = t.AddDate(0, 0, 1) {
+		day, err := findDateSlots(db, findSlotInput, users, optional, t, notBefore)
+		if errors.Is(err, errNoAvailability) {
+			continue
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "something went wrong",
+			})
+			return
+		}
+		if findSlotInput.Next != 0 && found+len(day.Slots) > findSlotInput.Next {
+			day.Slots = day.Slots[:findSlotInput.Next-found]
+		}
+		if len(day.Slots) > 0 {
+			dates = append(dates, day)
+			found += len(day.Slots)
+		}
+		if findSlotInput.Next != 0 && found == findSlotInput.Next {
+			break
+		}
+	}
+
+	if findSlotInput.LegacyFormat {
+		legacyDates := []gin.H{}
+		for _, day := range dates {
+			slots, optionalAvailable := legacySlots(day.Slots)
+			legacyDay := gin.H{
+				"date":  day.Date,
+				"slots": slots,
+			}
+			if len(optional) > 0 {
+				legacyDay["optional_available"] = optionalAvailable
+			}
+			legacyDates = append(legacyDates, legacyDay)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"from":      from.Format(layout),
+			"to":        to.Format(layout),
+			"time_zone": loc.String(),
+			"dates":     legacyDates,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"from":      from.Format(layout),
+		"to":        to.Format(layout),
+		"time_zone": loc.String(),
+		"dates":     dates,
+	})
+}
+
+// findDateSlots lists the slots on date, midnight in the time zone of the
+// caller, that are available for all the users and for at least quorum of
+// the optional ones. Slots starting before notBefore are left out, slots are
+// sorted chronologically
+func findDateSlots(q querier, input findAvailableSlotInput, users []int, optional []int, date time.Time, notBefore time.Time) (dateSlots, error) {
+	day := dateSlots{
+		Date:  date.Format("2006-01-02"),
+		Slots: []slotView{},
+	}
+	userSlotPtr, userSlotMapPtr, err := getSlotDiffs(q, input.slotInput, date, input.SlotConfig.Every, 0, optional...)
+	if err != nil {
+		return day, err
+	}
+
+	userSlot := *userSlotPtr
+	userSlotInfo := *userSlotMapPtr
+
+	// Now for every slot of the organizer, find out if the same slot is available for everyone else
+	// and for at least quorum of the optional attendees
+	loc := date.Location()
+	for slot, slotRange := range userSlotInfo[users[0]] {
+		if slotRange.Start.Before(notBefore) || !availableForAll(userSlot, users, slot) {
+			continue
+		}
+		free := []int{}
+		for _, user := range optional {
+			if userSlot[user][slot] {
+				free = append(free, user)
+			}
+		}
+		if len(free) < input.Quorum {
+			continue
+		}
+		view := newSlotView(slotRange, loc)
+		view.OptionalAvailable = free
+		day.Slots = append(day.Slots, view)
+	}
+	sortSlotViews(day.Slots)
+	return day, nil
+}
+
+// retrieves availability windows set by user on a given weekday
+// ordered by start time, sql.ErrNoRows is returned when there are none
+// // simple lookup against database
+func getUserWeeklyAvailability(q querier, user int, dayOfTheWeek string) ([]userAvailability, error) {
+	rows, err := q.Query(getUserAvailabilitySetting, user, dayOfTheWeek)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []userAvailability
+	for rows.Next() {
+		var window userAvailability
+		if err = rows.Scan(&window.UserId, &window.StartTimeHour, &window.StartTimeMinutes, &window.EndTimeHour, &window.EndTimeMinutes); err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(windows) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return windows, nil
+}
+
+// getUserAvailability expands the recurring availability of a user on a
+// calendar date, midnight in the user's time zone: the weekly windows of its
+// weekday along with the rules covering it. Overlapping windows are merged
+// and sql.ErrNoRows is returned when there are none
+func getUserAvailability(q querier, user int, date time.Time) ([]userAvailability, error) {
+	windows, err := getUserWeeklyAvailability(q, user, dayOfTheWeekMap[date.Weekday()])
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	day := date.Format("2006-01-02")
+	rows, err := q.Query(getUserAvailabilityRules, user, day, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recurrence, startDate string
+		var window userAvailability
+		if err = rows.Scan(&window.UserId, &recurrence, &startDate, &window.StartTimeHour, &window.StartTimeMinutes, &window.EndTimeHour, &window.EndTimeMinutes); err != nil {
+			return nil, err
+		}
+		rule, err := parseRecurrence(recurrence, date.Location())
+		if err != nil {
+			return nil, err
+		}
+		start, err := time.ParseInLocation("2006-01-02", startDate, date.Location())
+		if err != nil {
+			return nil, err
+		}
+		// the end date of the rule bounds its COUNT, occurrences start with
+		// the window, which a date-time UNTIL is compared with
+		at := func(day time.Time) time.Time {
+			return time.Date(day.Year(), day.Month(), day.Day(), window.StartTimeHour, window.StartTimeMinutes, 0, 0, day.Location())
+		}
+		if rule.includes(at(start), at(date)) {
+			windows = append(windows, window)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(windows) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return mergeAvailability(windows), nil
+}
+
+// mergeAvailability sorts windows by start time and merges the ones that
+// overlap or touch
+func mergeAvailability(windows []userAvailability) []userAvailability {
+	sort.Slice(windows, func(i, j int) bool {
+		a, _ := mergeToHourMinute(windows[i].StartTimeHour, windows[i].StartTimeMinutes)
+		b, _ := mergeToHourMinute(windows[j].StartTimeHour, windows[j].StartTimeMinutes)
+		return a < b
+	})
+	merged := []userAvailability{}
+	for _, window := range windows {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			lastEnd, _ := mergeToHourMinute(last.EndTimeHour, last.EndTimeMinutes)
+			start, _ := mergeToHourMinute(window.StartTimeHour, window.StartTimeMinutes)
+			end, _ := mergeToHourMinute(window.EndTimeHour, window.EndTimeMinutes)
+			if start <= lastEnd {
+				if end > lastEnd {
+					last.EndTimeHour, last.EndTimeMinutes = window.EndTimeHour, window.EndTimeMinutes
+				}
+				continue
+			}
+		}
+		merged = append(merged, window)
+	}
+	return merged
+}
+
+// getUserAvailabilityForDate resolves the availability windows of a user on a
+// calendar date. Date specific overrides win over the recurring availability,
+// the most recent one covering the date being the only one to apply: its
+// windows, or no windows at all when it is time off
+func getUserAvailabilityForDate(q querier, user int, date time.Time) ([]userAvailability, error) {
+	day := date.Format("2006-01-02")
+	overrides, err := getAvailabilityOverrides(q, user, day, day)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) == 0 {
+		return getUserAvailability(q, user, date)
+	}
+
+	// the windows of one override are stored together, with its dates
+	latest := overrides[0]
+	windows := []userAvailability{}
+	for _, override := range overrides {
+		if override.StartDate != latest.StartDate || override.EndDate != latest.EndDate || override.Available != latest.Available {
+			continue
+		}
+		if override.Available {
+			windows = append(windows, override.Window)
+		}
+	}
+	return mergeAvailability(windows), nil
+}
+
+// requestLocation is the time zone the date and slots of a request are read
+// in: timeZone, the caller's own, when given or else the one of user
+func requestLocation(q querier, timeZone string, user int) (*time.Location, error) {
+	if timeZone != "" {
+		loc, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, errInvalidTimeZone
+		}
+		return loc, nil
+	}
+	return getUserLocation(q, user)
+}
+
+// getUserLocation loads the IANA time zone a user's availability is read in
+func getUserLocation(q querier, user int) (*time.Location, error) {
+	var timeZone string
+	if err := q.QueryRow(getUserTimeZone, user).Scan(&timeZone); err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(timeZone)
+}
+
+// getUserWindows resolves the availability of a user between from and to as
+// absolute time ranges. Every calendar date touched by the range is read in
+// the user's own time zone, so a window of 09:00-17:00 in Berlin is anchored
+// to Berlin wall clock time including DST shifts. sql.ErrNoRows is returned
+// when the user has no availability configured for any of those dates
+func getUserWindows(q querier, user int, from time.Time, to time.Time) ([]timeRange, error) {
+	loc, err := getUserLocation(q, user)
+	if err != nil {
+		return nil, err
+	}
+	first := from.In(loc)
+	last := to.Add(-time.Nanosecond).In(loc)
+
+	configured := false
+	ranges := []timeRange{}
+	for day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc); !day.After(last); day = day.AddDate(0, 0, 1) {
+		windows, err := getUserAvailabilityForDate(q, user, day)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		configured = true
+		for _, window := range windows {
+			r := timeRange{
+				Start: time.Date(day.Year(), day.Month(), day.Day(), window.StartTimeHour, window.StartTimeMinutes, 0, 0, loc),
+				End:   time.Date(day.Year(), day.Month(), day.Day(), window.EndTimeHour, window.EndTimeMinutes, 0, 0, loc),
+			}
+			if r.Start.Before(from) {
+				r.Start = from
+			}
+			if r.End.After(to) {
+				r.End = to
+			}
+			if r.Start.Before(r.End) {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+	if !configured {
+		return nil, sql.ErrNoRows
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start.Before(ranges[j].Start)
+	})
+	return ranges, nil
+}
+
+// maxOccurrences caps the occurrences of a recurring booking
+const maxOccurrences = 52
+
+// maxRecurrenceYears bounds the expansion of a rule, a rule whose dates stop
+// matching, or that has fewer than COUNT of them, ends that many years after
+// its start
+const maxRecurrenceYears = 100
+
+// recurrenceRule is the subset of an RFC 5545 RRULE bookings, availability
+// rules and imported events repeat with: FREQ (DAILY, WEEKLY, MONTHLY or
+// YEARLY), INTERVAL, COUNT, UNTIL and BYDAY, with ordinals such as 1MO or -1FR
+// on monthly rules. Weeks start on monday. UNTIL is the last instant an
+// occurrence may start at: a UTC or floating date-time, or the end of a date
+type recurrenceRule struct {
+	Freq     string
+	Interval int
+	Count    int
+	Until    time.Time
+	ByDay    []recurrenceDay
+}
+
+// recurrenceDay is a BYDAY entry, Ordinal is the n-th (or from the end when
+// negative) such weekday of the month, 0 for every one of them
+type recurrenceDay struct {
+	Weekday time.Weekday
+	Ordinal int
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// parseRecurrence reads an RRULE such as FREQ=WEEKLY;BYDAY=MO,TH;COUNT=8,
+// floating UNTIL date-times and dates are read in loc
+func parseRecurrence(rule string, loc *time.Location) (recurrenceRule, error) {
+	r := recurrenceRule{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:"), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return r, fmt.Errorf("invalid recurrence part %q", part)
+		}
+		var err error
+		switch name {
+		case "FREQ":
+			if value != "DAILY" && value != "WEEKLY" && value != "MONTHLY" && value != "YEARLY" {
+				return r, errors.New("FREQ has to be DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+			r.Freq = value
+		case "INTERVAL":
+			if r.Interval, err = strconv.Atoi(value); err != nil || r.Interval < 1 {
+				return r, errors.New("INTERVAL has to be a positive number")
+			}
+		case "COUNT":
+			if r.Count, err = strconv.Atoi(value); err != nil || r.Count < 1 {
+				return r, errors.New("COUNT has to be a positive number")
+			}
+		case "UNTIL":
+			if r.Until, err = parseICSTime(value, nil, loc); err != nil {
+				return r, errors.New("UNTIL has to be formatted as yyyymmdd or yyyymmddThhmmss[Z]")
+			}
+			// a date includes all of it
+			if len(value) == 8 {
+				r.Until = r.Until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				if len(day) < 2 {
+					return r, fmt.Errorf("invalid BYDAY %q", day)
+				}
+				weekday, ok := rruleWeekdays[day[len(day)-2:]]
+				ordinal := 0
+				if len(day) > 2 {
+					ordinal, err = strconv.Atoi(day[:len(day)-2])
+				}
+				if !ok || err != nil || ordinal < -5 || ordinal > 5 {
+					return r, fmt.Errorf("invalid BYDAY %q", day)
+				}
+				r.ByDay = append(r.ByDay, recurrenceDay{Weekday: weekday, Ordinal: ordinal})
+			}
+		case "WKST":
+			// weeks always start on monday
+		default:
+			return r, fmt.Errorf("unsupported recurrence part %s", name)
+		}
+	}
+	if r.Freq == "" {
+		return r, errors.New("recurrence needs a FREQ")
+	}
+	if r.Freq == "YEARLY" && len(r.ByDay) > 0 {
+		return r, errors.New("BYDAY is not supported with FREQ=YEARLY")
+	}
+	if r.Freq != "MONTHLY" {
+		for _, day := range r.ByDay {
+			if day.Ordinal != 0 {
+				return r, errors.New("BYDAY ordinals are only supported with FREQ=MONTHLY")
+			}
+		}
+	}
+	return r, nil
+}
+
+// matches reports whether date is one of the BYDAY weekdays, any date does
+// when BYDAY is not set
+func (r recurrenceRule) matches(date time.Time) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	lastDay := time.Date(date.Year(), date.Month()+1, 0, 0, 0, 0, 0, date.Location()).Day()
+	for _, day := range r.ByDay {
+		if date.Weekday() != day.Weekday {
+			continue
+		}
+		if day.Ordinal == 0 ||
+			(day.Ordinal > 0 && (date.Day()-1)/7+1 == day.Ordinal) ||
+			(day.Ordinal < 0 && (lastDay-date.Day())/7+1 == -day.Ordinal) {
+			return true
+		}
+	}
+	return false
+}
+
+// period returns the start of the n-th period of the rule starting at start:
+// the day itself on a daily rule, the monday of the week, or the first day of
+// the month or the year, at the time of day of start
+func (r recurrenceRule) period(start time.Time, n int) time.Time {
+	switch r.Freq {
+	case "DAILY":
+		return start.AddDate(0, 0, n*r.Interval)
+	case "WEEKLY":
+		return start.AddDate(0, 0, 7*n*r.Interval-(int(start.Weekday())+6)%7)
+	case "YEARLY":
+		return time.Date(start.Year()+n*r.Interval, time.January, 1, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+	default:
+		return time.Date(start.Year(), start.Month()+time.Month(n*r.Interval), 1, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+	}
+}
+
+// candidates lists the dates of the n-th period of the rule starting at
+// start, before they are matched against BYDAY. They keep the time of day of
+// start
+func (r recurrenceRule) candidates(start time.Time, n int) []time.Time {
+	first := r.period(start, n)
+	switch r.Freq {
+	case "DAILY":
+		return []time.Time{first}
+	case "WEEKLY":
+		if len(r.ByDay) == 0 {
+			return []time.Time{first.AddDate(0, 0, (int(start.Weekday())+6)%7)}
+		}
+		var week []time.Time
+		for offset := 0; offset < 7; offset++ {
+			week = append(week, first.AddDate(0, 0, offset))
+		}
+		return week
+	case "YEARLY":
+		// years lacking the day of start, e.g. february 29th, are skipped
+		date := first.AddDate(0, int(start.Month())-1, start.Day()-1)
+		if date.Day() != start.Day() {
+			return nil
+		}
+		return []time.Time{date}
+	default:
+		if len(r.ByDay) == 0 {
+			// months lacking the day of start are skipped
+			date := first.AddDate(0, 0, start.Day()-1)
+			if date.Month() != first.Month() {
+				return nil
+			}
+			return []time.Time{date}
+		}
+		var month []time.Time
+		for date := first; date.Month() == first.Month(); date = date.AddDate(0, 0, 1) {
+			month = append(month, date)
+		}
+		return month
+	}
+}
+
+// expand lists up to limit occurrences of the rule starting at start, start
+// itself being the first one when it matches, and reports whether the rule
+// has more of them than that. The walk is bounded by date: it stops at UNTIL,
+// at end unless it's zero, or maxRecurrenceYears after start
+func (r recurrenceRule) expand(start time.Time, end time.Time, limit int) ([]time.Time, bool) {
+	bound := start.AddDate(maxRecurrenceYears, 0, 0)
+	if !r.Until.IsZero() && r.Until.Before(bound) {
+		bound = r.Until
+	}
+	if !end.IsZero() && end.Before(bound) {
+		bound = end
+	}
+	var dates []time.Time
+	for n := 0; !r.period(start, n).After(bound); n++ {
+		for _, date := range r.candidates(start, n) {
+			if date.Before(start) || !r.matches(date) {
+				continue
+			}
+			if date.After(bound) {
+				return dates, false
+			}
+			if len(dates) == limit {
+				return dates, true
+			}
+			dates = append(dates, date)
+			if len(dates) == r.Count {
+				return dates, false
+			}
+		}
+	}
+	return dates, false
+}
+
+// occurrences lists the starts of the occurrences of a recurring booking
+// whose first one is at start, the rule has to end with either COUNT or UNTIL
+func (r recurrenceRule) occurrences(start time.Time) ([]time.Time, error) {
+	if r.Count == 0 && r.Until.IsZero() {
+		return nil, errors.New("recurrence needs a COUNT or an UNTIL")
+	}
+	dates, more := r.expand(start, time.Time{}, maxOccurrences)
+	if more {
+		return nil, fmt.Errorf("a recurrence cannot have more than %d occurrences", maxOccurrences)
+	}
+	return dates, nil
+}
+
+// bounded turns the COUNT of the rule starting at start into the UNTIL of its
+// last occurrence, expanding it once so that includes doesn't have to. A rule
+// without any occurrence ends before start
+func (r recurrenceRule) bounded(start time.Time) recurrenceRule {
+	if r.Count == 0 {
+		return r
+	}
+	dates, _ := r.expand(start, time.Time{}, r.Count)
+	r.Count = 0
+	r.Until = start.Add(-time.Nanosecond)
+	if len(dates) > 0 {
+		r.Until = dates[len(dates)-1]
+	}
+	return r
+}
+
+// includes reports whether an occurrence of the rule starting at start
+// starts at date, both being at the same time of day in the rule's time
+// zone. It doesn't expand the rule and leaves COUNT out, the rule has to be
+// bounded first
+func (r recurrenceRule) includes(start time.Time, date time.Time) bool {
+	if date.Before(start) || (!r.Until.IsZero() && date.After(r.Until)) {
+		return false
+	}
+	switch r.Freq {
+	case "DAILY":
+		return civilDays(start, date)%r.Interval == 0 && r.matches(date)
+	case "WEEKLY":
+		monday := func(t time.Time) time.Time {
+			return t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+		}
+		if (civilDays(monday(start), monday(date))/7)%r.Interval != 0 {
+			return false
+		}
+		if len(r.ByDay) == 0 {
+			return date.Weekday() == start.Weekday()
+		}
+		return r.matches(date)
+	case "YEARLY":
+		return (date.Year()-start.Year())%r.Interval == 0 && date.Month() == start.Month() && date.Day() == start.Day()
+	default:
+		months := (date.Year()-start.Year())*12 + int(date.Month()) - int(start.Month())
+		if months%r.Interval != 0 {
+			return false
+		}
+		if len(r.ByDay) == 0 {
+			return date.Day() == start.Day()
+		}
+		return r.matches(date)
+	}
+}
+
+// civilDays counts the calendar days from a to b, whatever the DST shifts in
+// between
+func civilDays(a time.Time, b time.Time) int {
+	a = time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	b = time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(b.Sub(a).Hours() / 24)
+}
+
+// bookingUID is the iCalendar UID of a booked slot, it never changes even
+// when the booking is rescheduled
+func bookingUID(id int) string {
+	return fmt.Sprintf("booking-%d@calenderapi", id)
+}
+
+// userCalAddress is the iCalendar address of a user
+func userCalAddress(user int) string {
+	return fmt.Sprintf("urn:calenderapi:user:%d", user)
+}
+
+// parseUserCalAddress reads the user id of a calendar address written by
+// userCalAddress
+func parseUserCalAddress(address string) (int, bool) {
+	id, ok := strings.CutPrefix(strings.ToLower(strings.TrimSpace(address)), "urn:calenderapi:user:")
+	if !ok {
+		return 0, false
+	}
+	user, err := strconv.Atoi(id)
+	return user, err == nil
+}
+
+// formatICSTime formats t as an iCalendar UTC date-time
+func formatICSTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// escapeICSText escapes an iCalendar TEXT value
+func escapeICSText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "").Replace(text)
+}
+
+// quoteICSParam quotes an iCalendar parameter value, double quotes can't be
+// escaped so they are dropped
+func quoteICSParam(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, "") + `"`
+}
+
+// writeICSLine writes a content line ending with CRLF, folded so that no line
+// is longer than 75 octets without splitting a UTF-8 sequence
+func writeICSLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// icsProperty is a content line of an iCalendar object
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icsEvent is the busy time of a VEVENT, or of a VFREEBUSY period. A
+// recurring event carries its RRULE and the occurrences it excludes, a
+// modified occurrence carries the start it replaces in RecurrenceID
+type icsEvent struct {
+	UID          string
+	Start        time.Time
+	End          time.Time
+	Rule         string
+	ExDates      []time.Time
+	RecurrenceID time.Time
+}
+
+var icsDurationPattern = regexp.MustCompile(`^\+?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// unfoldICS splits content into unfolded content lines
+func unfoldICS(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseICSProperty reads a content line, NAME;PARAM=value:VALUE, where
+// parameter values may be quoted
+func parseICSProperty(line string) (icsProperty, bool) {
+	prop := icsProperty{Params: make(map[string]string)}
+	quoted := false
+	fields := []string{}
+	last := 0
+	for i, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case (r == ';' || r == ':') && !quoted:
+			fields = append(fields, line[last:i])
+			last = i + 1
+			if r == ':' {
+				prop.Name = strings.ToUpper(fields[0])
+				for _, param := range fields[1:] {
+					name, value, _ := strings.Cut(param, "=")
+					prop.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+				}
+				prop.Value = line[last:]
+				return prop, prop.Name != ""
+			}
+		}
+	}
+	return prop, false
+}
+
+// parseICSTime reads a DATE or DATE-TIME value, floating times and dates are
+// read in loc unless a known TZID is given
+func parseICSTime(value string, params map[string]string, loc *time.Location) (time.Time, error) {
+	if tzid, ok := params["TZID"]; ok {
+		if tz, err := time.LoadLocation(tzid); err == nil {
+			loc = tz
+		}
+	}
+	switch {
+	case len(value) == 8:
+		return time.ParseInLocation("20060102", value, loc)
+	case strings.HasSuffix(value, "Z"):
+		return time.Parse("20060102T150405Z", value)
+	default:
+		return time.ParseInLocation("20060102T150405", value, loc)
+	}
 }
 
-func getSlotDiffs(input slotInput, dayOfTheWeek string, every int) (*map[int]availabilityStatus, *map[int]availabilityInfo, error) {
-	// Create an insert statement to be executed on the database
-	db, err := sql.Open("sqlite3", file)
+// parseICSDuration reads a positive DURATION value such as PT1H30M or P1D
+func parseICSDuration(value string) (time.Duration, error) {
+	parts := icsDurationPattern.FindStringSubmatch(value)
+	if parts == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	var d time.Duration
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	for i, unit := range units {
+		if parts[i+1] != "" {
+			n, _ := strconv.Atoi(parts[i+1])
+			d += time.Duration(n) * unit
+		}
+	}
+	return d, nil
+}
+
+// parseICSEvents reads the busy time of an iCalendar object: its VEVENTs,
+// leaving out cancelled and transparent ones, and the BUSY periods of its
+// VFREEBUSYs. Floating times and dates are read in loc
+func parseICSEvents(content string, loc *time.Location) ([]icsEvent, error) {
+	lines := unfoldICS(content)
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, errors.New("not an iCalendar file, it has to start with BEGIN:VCALENDAR")
+	}
+
+	// the open components and their own properties, nested ones such as a
+	// VALARM of a VEVENT keeping theirs apart
+	var events []icsEvent
+	var components []string
+	var props [][]icsProperty
+	for _, line := range lines {
+		prop, ok := parseICSProperty(line)
+		if !ok {
+			continue
+		}
+		switch prop.Name {
+		case "BEGIN":
+			components = append(components, strings.ToUpper(prop.Value))
+			props = append(props, nil)
+		case "END":
+			last := len(components) - 1
+			if last < 0 || !strings.EqualFold(prop.Value, components[last]) {
+				return nil, errors.New("unbalanced END in the iCalendar file")
+			}
+			switch components[last] {
+			case "VEVENT":
+				event, ok, err := icsEventFrom(props[last], loc)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					events = append(events, event)
+				}
+			case "VFREEBUSY":
+				busy, err := icsFreeBusyFrom(props[last])
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, busy...)
+			}
+			components, props = components[:last], props[:last]
+		default:
+			if len(props) > 0 {
+				props[len(props)-1] = append(props[len(props)-1], prop)
+			}
+		}
+	}
+	return events, nil
+}
+
+// icsEventFrom turns the properties of a VEVENT into busy time, it reports
+// false for events that don't block time
+func icsEventFrom(props []icsProperty, loc *time.Location) (icsEvent, bool, error) {
+	var event icsEvent
+	var duration string
+	allDay := false
+	hasEnd := false
+	for _, prop := range props {
+		var err error
+		switch prop.Name {
+		case "UID":
+			event.UID = prop.Value
+		case "DTSTART":
+			event.Start, err = parseICSTime(prop.Value, prop.Params, loc)
+			allDay = len(prop.Value) == 8
+		case "DTEND":
+			event.End, err = parseICSTime(prop.Value, prop.Params, loc)
+			hasEnd = true
+		case "DURATION":
+			duration = prop.Value
+		case "RRULE":
+			event.Rule = prop.Value
+		case "EXDATE":
+			for _, value := range strings.Split(prop.Value, ",") {
+				exdate, err := parseICSTime(value, prop.Params, loc)
+				if err != nil {
+					return event, false, fmt.Errorf("invalid EXDATE %q", value)
+				}
+				event.ExDates = append(event.ExDates, exdate)
+			}
+		case "RECURRENCE-ID":
+			event.RecurrenceID, err = parseICSTime(prop.Value, prop.Params, loc)
+		case "STATUS":
+			if strings.EqualFold(prop.Value, "CANCELLED") {
+				return event, false, nil
+			}
+		case "TRANSP":
+			if strings.EqualFold(prop.Value, "TRANSPARENT") {
+				return event, false, nil
+			}
+		}
+		if err != nil {
+			return event, false, fmt.Errorf("invalid %s %q", prop.Name, prop.Value)
+		}
+	}
+	if event.Start.IsZero() {
+		return event, false, errors.New("VEVENT without a DTSTART")
+	}
+	switch {
+	case hasEnd:
+	case duration != "":
+		d, err := parseICSDuration(duration)
+		if err != nil {
+			return event, false, err
+		}
+		event.End = event.Start.Add(d)
+	case allDay:
+		event.End = event.Start.AddDate(0, 0, 1)
+	default:
+		event.End = event.Start
+	}
+	// events taking no time don't block anything
+	return event, event.End.After(event.Start), nil
+}
+
+// icsFreeBusyFrom reads the BUSY periods of a VFREEBUSY, start/end or
+// start/duration in UTC
+func icsFreeBusyFrom(props []icsProperty) ([]icsEvent, error) {
+	var events []icsEvent
+	for _, prop := range props {
+		if prop.Name != "FREEBUSY" || strings.EqualFold(prop.Params["FBTYPE"], "FREE") {
+			continue
+		}
+		for _, period := range strings.Split(prop.Value, ",") {
+			startValue, endValue, ok := strings.Cut(period, "/")
+			if !ok {
+				return nil, fmt.Errorf("invalid FREEBUSY period %q", period)
+			}
+			start, err := parseICSTime(startValue, nil, time.UTC)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FREEBUSY period %q", period)
+			}
+			end, err := parseICSTime(endValue, nil, time.UTC)
+			if err != nil {
+				d, durationErr := parseICSDuration(endValue)
+				if durationErr != nil {
+					return nil, fmt.Errorf("invalid FREEBUSY period %q", period)
+				}
+				end = start.Add(d)
+			}
+			if end.After(start) {
+				events = append(events, icsEvent{Start: start, End: end})
+			}
+		}
+	}
+	return events, nil
+}
+
+// icsBusyBetween expands events into the busy time ranges overlapping from
+// and to. Occurrences of recurring events are looked up date by date in the
+// event's time zone, leaving out EXDATEs and the occurrences replaced by a
+// modified one. An RRULE this service can't read only blocks its first
+// occurrence
+func icsBusyBetween(events []icsEvent, from time.Time, to time.Time) []timeRange {
+	window := timeRange{Start: from, End: to}
+	replaced := make(map[string][]time.Time)
+	for _, event := range events {
+		if !event.RecurrenceID.IsZero() {
+			replaced[event.UID] = append(replaced[event.UID], event.RecurrenceID)
+		}
+	}
+
+	busy := []timeRange{}
+	for _, event := range events {
+		r := timeRange{Start: event.Start, End: event.End}
+		rule, err := parseRecurrence(event.Rule, event.Start.Location())
+		if event.Rule == "" || !event.RecurrenceID.IsZero() || err != nil {
+			if r.overlaps(window) {
+				busy = append(busy, r)
+			}
+			continue
+		}
+
+		loc := event.Start.Location()
+		length := event.End.Sub(event.Start)
+		rule = rule.bounded(event.Start)
+		excluded := append(event.ExDates, replaced[event.UID]...)
+		lookupStart := from.Add(-length).In(loc)
+		for day := time.Date(lookupStart.Year(), lookupStart.Month(), lookupStart.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+			start := time.Date(day.Year(), day.Month(), day.Day(), event.Start.Hour(), event.Start.Minute(), event.Start.Second(), 0, loc)
+			if !rule.includes(event.Start, start) {
+				continue
+			}
+			skip := false
+			for _, exdate := range excluded {
+				// a DATE exdate excludes the occurrence on that date
+				if exdate.Equal(start) || (exdate.Equal(day) && exdate.Hour() == 0 && exdate.Minute() == 0) {
+					skip = true
+					break
+				}
+			}
+			occurrence := timeRange{Start: start, End: start.Add(length)}
+			if !skip && occurrence.overlaps(window) {
+				busy = append(busy, occurrence)
+			}
+		}
+	}
+	return busy
+}
+
+// getUserExternalBusy reads the busy time of every external calendar of a
+// user between from and to. A registered file that can't be read anymore is
+// skipped
+func getUserExternalBusy(q querier, user int, from time.Time, to time.Time) ([]timeRange, error) {
+	rows, err := q.Query(getUserExternalCalendars, user)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	defer db.Close()
-	user1, err := getUserAvailability(input.UserID1, dayOfTheWeek)
+	defer rows.Close()
+
+	type calendar struct {
+		id      int
+		path    sql.NullString
+		content sql.NullString
+	}
+	var calendars []calendar
+	for rows.Next() {
+		var cal calendar
+		if err = rows.Scan(&cal.id, &cal.path, &cal.content); err != nil {
+			return nil, err
+		}
+		calendars = append(calendars, cal)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(calendars) == 0 {
+		return nil, nil
+	}
+
+	loc, err := getUserLocation(q, user)
 	if err != nil {
-		return nil, nil, errors.New("no availability set for user 1")
+		return nil, err
+	}
+	var busy []timeRange
+	for _, cal := range calendars {
+		content := cal.content.String
+		if cal.path.Valid {
+			// the file, or a link on the way, may have changed since it was
+			// registered
+			path, err := importablePath(cal.path.String)
+			if err != nil {
+				log.Printf("external calendar %d of user %d left out: %v", cal.id, user, err)
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("external calendar %d of user %d left out: %v", cal.id, user, err)
+				continue
+			}
+			content = string(data)
+		}
+		events, err := parseICSEvents(content, loc)
+		if err != nil {
+			log.Printf("external calendar %d of user %d left out: %v", cal.id, user, err)
+			continue
+		}
+		busy = append(busy, icsBusyBetween(events, from, to)...)
 	}
-	user2, err := getUserAvailability(input.UserID2, dayOfTheWeek)
+	return busy, nil
+}
+
+// isPastDate reports whether date, midnight in some time zone, is before
+// today in that time zone
+func isPastDate(date time.Time) bool {
+	today := now().In(date.Location())
+	return date.Before(time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, date.Location()))
+}
+
+// utility
+func mergeToHourMinute(hour int, minute int) (int, error) {
+	hourMinuteStr := fmt.Sprintf("%02d%02d", hour, minute)
+	hourMinute, err := strconv.Atoi(hourMinuteStr)
 	if err != nil {
-		return nil, nil, errors.New("no availability set for user 2")
+		return 0, err
 	}
+	return hourMinute, nil
+}
 
-	requestedSlotDuration := input.SlotConfig.SlotDuration
+// weekdayFromName maps monday, tuesday, .. back to a time.Weekday
+func weekdayFromName(day string) (time.Weekday, bool) {
+	for weekday, name := range dayOfTheWeekMap {
+		if name == day {
+			return weekday, true
+		}
+	}
+	return time.Sunday, false
+}
 
-	if _, ok := durationToInt[requestedSlotDuration]; !ok {
-		return nil, nil, errors.New("unsupported duration")
+// validateAvailabilityWindows checks every window is well formed and that
+// no two windows of the same day overlap
+func validateAvailabilityWindows(windows []availabilityWindow) error {
+	for i, window := range windows {
+		if window.StartTimeHour < 1 || window.StartTimeHour > 23 || window.EndTimeHour < 0 || window.EndTimeHour > 23 ||
+			window.StartTimeMinutes < 0 || window.StartTimeMinutes > 59 || window.EndTimeMinutes < 0 || window.EndTimeMinutes > 59 {
+			return fmt.Errorf("window %d is out of range", i+1)
+		}
+		start, _ := mergeToHourMinute(window.StartTimeHour, window.StartTimeMinutes)
+		end, _ := mergeToHourMinute(window.EndTimeHour, window.EndTimeMinutes)
+		if start >= end {
+			return errors.New("start and end time cannot be equal or greater than end time")
+		}
+		for _, other := range windows[:i] {
+			otherStart, _ := mergeToHourMinute(other.StartTimeHour, other.StartTimeMinutes)
+			otherEnd, _ := mergeToHourMinute(other.EndTimeHour, other.EndTimeMinutes)
+			if start < otherEnd && otherStart < end {
+				return fmt.Errorf("window %02d:%02d-%02d:%02d overlaps with %02d:%02d-%02d:%02d", window.StartTimeHour, window.StartTimeMinutes, window.EndTimeHour, window.EndTimeMinutes, other.StartTimeHour, other.StartTimeMinutes, other.EndTimeHour, other.EndTimeMinutes)
+			}
+		}
 	}
+	return nil
+}
 
-	userSlot := make(map[int]availabilityStatus)
-	userSlotInfo := make(map[int]availabilityInfo)
+// intersectTimeRanges returns the ranges covered by both a and b, both
+// inputs have to be sorted and free of overlaps
+func intersectTimeRanges(a []timeRange, b []timeRange) []timeRange {
+	intersection := []timeRange{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].Start, a[i].End
+		if b[j].Start.After(start) {
+			start = b[j].Start
+		}
+		if b[j].End.Before(end) {
+			end = b[j].End
+		}
+		if start.Before(end) {
+			intersection = append(intersection, timeRange{Start: start, End: end})
+		}
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return intersection
+}
 
-	// tip: this function update's the map by reference
-	err = buildSlotAvailability(user1, &userSlot, &userSlotInfo, requestedSlotDuration, every)
+// isDatabaseBusy reports whether err is the database staying locked by
+// another write past the busy timeout
+func isDatabaseBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// isBookingOverlap reports whether err was raised by the no overlap triggers
+// on calendar_user_booked_slots
+func isBookingOverlap(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintTrigger
+}
+
+// formatTimestamp formats t the way starts_at/ends_at are stored
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// end of utility
+
+// buildSlotAvailability builds a map, keyed by the UTC start of the slots as
+// an RFC 3339 timestamp, of durationMinutes long slots starting every `every`
+// minutes across every availability window of a user. Wall clock times repeat
+// when the clocks are turned back, instants don't
+func buildSlotAvailability(user int, windows []timeRange, loc *time.Location, userSlot *map[int]availabilityStatus, userSlotInfo *map[int]availabilityInfo, durationMinutes int, every int) error {
+	// make sure the user map exists even on a day off or when a window is
+	// too short to hold a slot
+	if _, ok := (*userSlot)[user]; !ok {
+		(*userSlot)[user] = make(map[string]bool)
+		(*userSlotInfo)[user] = make(map[string]timeRange)
+	}
+	if every <= 0 {
+		return errors.New("invalid search interval")
+	}
+	duration := time.Duration(durationMinutes) * time.Minute
+	// stepping in absolute time keeps slots right across DST transitions
+	for _, window := range windows {
+		for start := window.Start; !start.Add(duration).After(window.End); start = start.Add(time.Duration(every) * time.Minute) {
+			slot := formatTimestamp(start)
+			(*userSlot)[user][slot] = true
+			(*userSlotInfo)[user][slot] = timeRange{
+				Start: start.In(loc),
+				End:   start.Add(duration).In(loc),
+			}
+		}
+	}
+	return nil
+}
+
+// getSlotDiffs builds the slot maps of every participant of input on date,
+// which is midnight in the time zone of the first participant. Windows of all
+// the participants are intersected in absolute time and slots are keyed in
+// the time zone of date, slots are keyed by their UTC start.
+// ignoreBooking (when non zero) is left out of the booked slots, e.g. the
+// booking being rescheduled. Booked slots are read through q so that callers
+// can run the check inside the transaction that books the slot.
+// optional users don't narrow the slots, a slot is available to them only
+// when it fits in their own windows
+func getSlotDiffs(q querier, input slotInput, date time.Time, every int, ignoreBooking int, optional ...int) (*map[int]availabilityStatus, *map[int]availabilityInfo, error) {
+	requestedSlotDuration, err := input.SlotConfig.minutes()
 	if err != nil {
 		return nil, nil, err
 	}
-	err = buildSlotAvailability(user2, &userSlot, &userSlotInfo, requestedSlotDuration, every)
+	users, err := input.participants()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// fmt.Println(userSlot)
-	// fmt.Println(userSlotInfo)
+	loc := date.Location()
+	dayStart := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+	dayEnd := dayStart.AddDate(0, 0, 1)
 
-	bookedSlots, err := db.Query(getUserBookedSlots, input.UserID1, input.UserID2, input.UserID1, input.UserID2, input.Date)
-	if err != nil {
-		return nil, nil, err
+	// slots are only generated where all the users are available
+	var common []timeRange
+	for i, user := range users {
+		windows, err := getUserWindows(q, user, dayStart, dayEnd)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w for user %d", errNoAvailability, user)
+		}
+		if i == 0 {
+			common = windows
+		} else {
+			common = intersectTimeRanges(common, windows)
+		}
 	}
 
-	// go through the list of booked slots for
-	// user_1 and user_2,
-	// mark the slots booked on either side to be available as false
-	for bookedSlots.Next() {
-		var slot scheduledSlot
-		if err := bookedSlots.Scan(&slot.UserID1, &slot.UserID2, &slot.Date, &slot.StartTimeHour, &slot.StartTimeMinutes, &slot.EndTimeHour, &slot.EndTimeMinutes, &slot.SlotDuration); err != nil {
-			// TODO: handle error
+	userSlot := make(map[int]availabilityStatus)
+	userSlotInfo := make(map[int]availabilityInfo)
+
+	for i, user := range append(users[:len(users):len(users)], optional...) {
+		// tip: this function update's the map by reference
+		err = buildSlotAvailability(user, common, loc, &userSlot, &userSlotInfo, requestedSlotDuration, every)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if i >= len(users) {
+			// an optional user without availability is never free
+			windows, _ := getUserWindows(q, user, dayStart, dayEnd)
+			for key, slotRange := range userSlotInfo[user] {
+				if !slotRange.within(windows) {
+					userSlot[user][key] = false
+				}
+			}
+		}
+
+		var bufferBefore, bufferAfter, notice, horizon int
+		if err := q.QueryRow(getUserBookingRules, user).Scan(&bufferBefore, &bufferAfter, &notice, &horizon); err != nil {
+			return nil, nil, err
+		}
+
+		// slots have to start after the user's minimum notice, never in the
+		// past, and within their rolling horizon
+		earliest := now().Add(time.Duration(notice) * time.Minute)
+		latest := now().AddDate(0, 0, horizon)
+		for key, slotRange := range userSlotInfo[user] {
+			if slotRange.Start.Before(earliest) || (horizon > 0 && !slotRange.Start.Before(latest)) {
+				userSlot[user][key] = false
+			}
+		}
+
+		// slots that would take the user over one of their caps
+		var caps meetingCaps
+		if err := q.QueryRow(getUserMeetingCaps, user).Scan(&caps.MaxMeetingsPerDay, &caps.MaxMinutesPerDay, &caps.MaxMeetingsPerWeek, &caps.MaxMinutesPerWeek); err != nil {
+			return nil, nil, err
+		}
+		if caps != (meetingCaps{}) {
+			userLoc, err := getUserLocation(q, user)
+			if err != nil {
+				return nil, nil, err
+			}
+			loads := make(map[string][2]int)
+			for key, slotRange := range userSlotInfo[user] {
+				code, err := meetingCapReached(q, user, caps, userLoc, slotRange, ignoreBooking, loads)
+				if err != nil {
+					return nil, nil, err
+				}
+				if code != "" {
+					userSlot[user][key] = false
+				}
+			}
+		}
+
+		// the user keeps a buffer before and after each of their meetings, the
+		// new one included, so bookings just outside the day count too
+		before := time.Duration(bufferBefore) * time.Minute
+		after := time.Duration(bufferAfter) * time.Minute
+		reach := max(before, after)
+
+		bookedSlots, err := q.Query(getUserBookedSlots, user, formatTimestamp(dayEnd.Add(reach)), formatTimestamp(dayStart.Add(-reach)), ignoreBooking)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// mark every slot overlapping a booking of the user, or breaking the
+		// buffer around it, as unavailable whatever the step size the
+		// booking was made with
+		for bookedSlots.Next() {
+			slot, err := scanScheduledSlot(bookedSlots)
+			if err != nil {
+				// TODO: handle error
+				continue
+			}
+			booked, err := slot.timeRange()
+			if err != nil {
+				continue
+			}
+			for key, slotRange := range userSlotInfo[user] {
+				if slotRange.pad(before, after).overlaps(booked) || slotRange.overlaps(booked.pad(before, after)) {
+					userSlot[user][key] = false
+				}
+			}
+		}
+		bookedSlots.Close()
+
+		// busy time from the user's external calendars is excluded the same way
+		busy, err := getUserExternalBusy(q, user, dayStart.Add(-reach), dayEnd.Add(reach))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, booked := range busy {
+			for key, slotRange := range userSlotInfo[user] {
+				if slotRange.pad(before, after).overlaps(booked) || slotRange.overlaps(booked.pad(before, after)) {
+					userSlot[user][key] = false
+				}
+			}
 		}
-		userSlot[slot.UserID1][fmt.Sprintf("%02d:%02d", slot.StartTimeHour, slot.StartTimeMinutes)] = false
-		userSlot[slot.UserID2][fmt.Sprintf("%02d:%02d", slot.StartTimeHour, slot.StartTimeMinutes)] = false
 	}
 
 	return &userSlot, &userSlotInfo, nil
 }
 
+// meetingCapReached tells which cap of user, if any, booking slot would go
+// over. Days and weeks are read in loc, the user's time zone, and the load of
+// each of them is kept in loads across calls
+func meetingCapReached(q querier, user int, caps meetingCaps, loc *time.Location, slot timeRange, ignoreBooking int, loads map[string][2]int) (string, error) {
+	start := slot.Start.In(loc)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	week := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	minutes := int(slot.End.Sub(slot.Start) / time.Minute)
+
+	load := func(period string, from time.Time, to time.Time) ([2]int, error) {
+		key := period + formatTimestamp(from)
+		if l, ok := loads[key]; ok {
+			return l, nil
+		}
+		var l [2]int
+		err := q.QueryRow(getUserBookedLoad, user, formatTimestamp(from), formatTimestamp(to), ignoreBooking).Scan(&l[0], &l[1])
+		if err != nil {
+			return l, err
+		}
+		loads[key] = l
+		return l, nil
+	}
+
+	if caps.MaxMeetingsPerDay > 0 || caps.MaxMinutesPerDay > 0 {
+		l, err := load("day", day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return "", err
+		}
+		if (caps.MaxMeetingsPerDay > 0 && l[0]+1 > caps.MaxMeetingsPerDay) || (caps.MaxMinutesPerDay > 0 && l[1]+minutes > caps.MaxMinutesPerDay) {
+			return dailyCapReached, nil
+		}
+	}
+	if caps.MaxMeetingsPerWeek > 0 || caps.MaxMinutesPerWeek > 0 {
+		l, err := load("week", week, week.AddDate(0, 0, 7))
+		if err != nil {
+			return "", err
+		}
+		if (caps.MaxMeetingsPerWeek > 0 && l[0]+1 > caps.MaxMeetingsPerWeek) || (caps.MaxMinutesPerWeek > 0 && l[1]+minutes > caps.MaxMinutesPerWeek) {
+			return weeklyCapReached, nil
+		}
+	}
+	return "", nil
+}
+
+// findMeetingCapReached returns the first of users that booking slot would
+// take over one of their caps, along with the cap's error code
+func findMeetingCapReached(q querier, users []int, slot timeRange, ignoreBooking int) (int, string, error) {
+	for _, user := range users {
+		var caps meetingCaps
+		if err := q.QueryRow(getUserMeetingCaps, user).Scan(&caps.MaxMeetingsPerDay, &caps.MaxMinutesPerDay, &caps.MaxMeetingsPerWeek, &caps.MaxMinutesPerWeek); err != nil {
+			return 0, "", err
+		}
+		if caps == (meetingCaps{}) {
+			continue
+		}
+		loc, err := getUserLocation(q, user)
+		if err != nil {
+			return 0, "", err
+		}
+		code, err := meetingCapReached(q, user, caps, loc, slot, ignoreBooking, make(map[string][2]int))
+		if err != nil {
+			return 0, "", err
+		}
+		if code != "" {
+			return user, code, nil
+		}
+	}
+	return 0, "", nil
+}
+
+// availableForAll reports whether slot is available for every one of users
+func availableForAll(userSlot map[int]availabilityStatus, users []int, slot string) bool {
+	for _, user := range users {
+		if !userSlot[user][slot] {
+			return false
+		}
+	}
+	return true
+}
+
 // initialize,
-// 1. creates required tables in the sqlite table
-// 2. hydrates constants
+// 1. migrates an existing database
+// 2. creates required tables in the sqlite table
+// 3. hydrates constants
 func initialize() {
 	db, err := sql.Open("sqlite3", file)
 	if err != nil {
@@ -819,6 +5973,9 @@ func initialize() {
 	s := server{
 		db: db,
 	}
+	if err := migrate(s.db); err != nil {
+		panic(err)
+	}
 	if _, err := s.db.Exec(userCreate); err != nil {
 		panic(err)
 	}
@@ -827,9 +5984,112 @@ func initialize() {
 		panic(err)
 	}
 
+	if _, err := s.db.Exec(availabilityIndexCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(availabilityOverrideCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(availabilityOverrideIndexCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(availabilityRuleCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(externalCalendarCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(webhookCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(webhookDeliveryCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(webhookDeliveryIndexCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(externalCalendarIndexCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(availabilityRuleIndexCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(bookingSeries); err != nil {
+		panic(err)
+	}
+
 	if _, err := s.db.Exec(bookedSlots); err != nil {
 		panic(err)
 	}
+
+	if _, err := s.db.Exec(bookedSlotsIndexCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(bookedSlotAttendees); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(bookedSlotAttendeesIndexCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(caldavObjectCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(bookingReminderCreate); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(bookedSlotsNoOverlapInsert); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.db.Exec(bookedSlotsNoOverlapUpdate); err != nil {
+		panic(err)
+	}
+	if minutes, err := strconv.Atoi(os.Getenv("MIN_SLOT_DURATION_MINUTES")); err == nil && minutes > 0 {
+		minSlotDuration = minutes
+	}
+	if minutes, err := strconv.Atoi(os.Getenv("MAX_SLOT_DURATION_MINUTES")); err == nil && minutes >= minSlotDuration {
+		maxSlotDuration = minutes
+	}
+	calendarImportDir = os.Getenv("ICS_IMPORT_DIR")
+	webhookAllowPrivate, _ = strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE"))
+	if value := os.Getenv("REMINDER_OFFSETS"); value != "" {
+		if offsets, err := parseReminderOffsets(value); err == nil {
+			reminderOffsets = offsets
+		} else {
+			log.Printf("REMINDER_OFFSETS ignored: %v", err)
+		}
+	}
+	if interval, err := time.ParseDuration(os.Getenv("REMINDER_INTERVAL")); err == nil && interval > 0 {
+		reminderInterval = interval
+	}
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "25"
+		}
+		smtpAddr = net.JoinHostPort(host, port)
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			smtpAuth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		if from := os.Getenv("SMTP_FROM"); from != "" {
+			smtpFrom = from
+		}
+	}
 	dayOfTheWeekMap[time.Monday] = "monday"
 	dayOfTheWeekMap[time.Tuesday] = "tuesday"
 	dayOfTheWeekMap[time.Wednesday] = "wednesday"
@@ -839,18 +6099,55 @@ func initialize() {
 	dayOfTheWeekMap[time.Sunday] = "sunday"
 }
 
-// main()
-func main() {
+// setupRouter registers the API routes
+func setupRouter() *gin.Engine {
 	r := gin.Default()
-	initialize()
 	v1 := r.Group("/v1")
 	{
 		v1.POST("/create-user", createUser)
+		v1.POST("/user/set-time-zone", setTimeZone)
+		v1.POST("/user/set-email", setEmail)
+		v1.POST("/user/caldav-password", setCalDAVPassword)
 		v1.POST("/user/view-schedule", viewSchedule)
 		v1.POST("/user/set-availability", setAvailability)
+		v1.POST("/user/set-buffer", setBuffer)
+		v1.POST("/user/set-notice", setNotice)
+		v1.POST("/user/set-meeting-caps", setMeetingCaps)
+		v1.PUT("/user/availability", updateAvailability)
+		v1.DELETE("/user/availability", deleteAvailability)
+		v1.POST("/user/availability-override", setAvailabilityOverride)
+		v1.DELETE("/user/availability-override", deleteAvailabilityOverride)
+		v1.POST("/user/availability-rule", setAvailabilityRule)
+		v1.DELETE("/user/availability-rule", deleteAvailabilityRule)
 		v1.POST("/user/find-available-slots", findAvailableSlots)
 		v1.POST("/user/book-slot", bookSlot)
+		v1.POST("/user/reschedule-slot", rescheduleSlot)
+		v1.POST("/user/cancel-slot", cancelSlot)
+		v1.POST("/user/free-busy", freeBusy)
+		v1.POST("/webhook", setWebhook)
+		v1.DELETE("/webhook", deleteWebhook)
+		v1.GET("/webhook/:id/deliveries", listWebhookDeliveries)
+		v1.GET("/user/:id/calendar.ics", exportCalendar)
+		v1.POST("/user/external-calendar/upload", uploadExternalCalendar)
+		v1.POST("/user/external-calendar", setExternalCalendar)
+		v1.DELETE("/user/external-calendar", deleteExternalCalendar)
+		v1.Handle(http.MethodOptions, "/caldav/:id/", caldavOptions)
+		v1.Handle("PROPFIND", "/caldav/:id/", caldavPropfind)
+		v1.Handle("REPORT", "/caldav/:id/", caldavReport)
+		v1.Handle(http.MethodOptions, "/caldav/:id/:name", caldavOptions)
+		v1.Handle("PROPFIND", "/caldav/:id/:name", caldavPropfind)
+		v1.GET("/caldav/:id/:name", caldavGetEvent)
+		v1.PUT("/caldav/:id/:name", caldavPutEvent)
+		v1.DELETE("/caldav/:id/:name", caldavDeleteEvent)
 	}
+	return r
+}
+
+// main()
+func main() {
+	initialize()
+	r := setupRouter()
+	go runReminders()
 	err := r.Run()
 	if err != nil {
 		panic("unable to run")
@@ -0,0 +1,2571 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testMonday is a monday a couple of weeks ahead, the tests book around it
+var testMonday = func() time.Time {
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 14)
+	for day.Weekday() != time.Monday {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}()
+
+// testNow is the clock of the tests, testMonday at 08:00
+var testNow = testMonday.Add(8 * time.Hour)
+
+// testDate returns the date days after testMonday
+func testDate(days int) string {
+	return testMonday.AddDate(0, 0, days).Format("2006-01-02")
+}
+
+// testDSN returns the data source name of a database in a temporary directory
+func testDSN(t *testing.T) string {
+	return fmt.Sprintf("file:%s?_foreign_keys=on&_txlock=immediate&_busy_timeout=5000", filepath.Join(t.TempDir(), "calendar.db"))
+}
+
+// newTestServer initializes a fresh database in a temporary directory and
+// returns the router serving it, its clock is testNow
+func newTestServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	dsn, clock := file, now
+	t.Cleanup(func() {
+		file, now = dsn, clock
+	})
+	file = testDSN(t)
+	now = func() time.Time { return testNow }
+	initialize()
+	return setupRouter()
+}
+
+// request sends body as JSON and decodes the JSON response, it is safe to
+// call from several goroutines
+func request(t *testing.T, r http.Handler, method, path string, body any) (int, map[string]any) {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Errorf("%s %s: %v", method, path, err)
+		return 0, nil
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	response := make(map[string]any)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Errorf("%s %s: invalid response %q", method, path, w.Body.String())
+	}
+	return w.Code, response
+}
+
+// expectStatus fails the test when a request doesn't respond with status
+func expectStatus(t *testing.T, what string, status, expected int, response map[string]any) {
+	t.Helper()
+	if status != expected {
+		t.Fatalf("%s: expected %d, got %d %v", what, expected, status, response)
+	}
+}
+
+// mustCreateUser creates a user without any availability
+func mustCreateUser(t *testing.T, r http.Handler, name string) int {
+	t.Helper()
+	status, response := request(t, r, http.MethodPost, "/v1/create-user", gin.H{"name": name})
+	expectStatus(t, "create-user", status, http.StatusOK, response)
+	return int(response["id"].(float64))
+}
+
+// addWindow adds a window, from hour start to hour end, to the weekly
+// availability of user on day
+func addWindow(t *testing.T, r http.Handler, user int, day string, start, end int) (int, map[string]any) {
+	t.Helper()
+	return request(t, r, http.MethodPost, "/v1/user/set-availability", gin.H{
+		"user_id":            strconv.Itoa(user),
+		"day":                day,
+		"start_time_hour":    start,
+		"start_time_minutes": 0,
+		"end_time_hour":      end,
+		"end_time_minutes":   0,
+	})
+}
+
+// createUsers creates n users, userN@example.com, available from 09:00 to
+// 17:00 every day
+func createUsers(t *testing.T, r http.Handler, n int) []int {
+	t.Helper()
+	var users []int
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("user%d", i+1)
+		status, response := request(t, r, http.MethodPost, "/v1/create-user", gin.H{"name": name, "email": name + "@example.com"})
+		expectStatus(t, "create-user", status, http.StatusOK, response)
+		user := int(response["id"].(float64))
+		for _, day := range dayOfTheWeekMap {
+			status, response := addWindow(t, r, user, day, 9, 17)
+			expectStatus(t, "set-availability", status, http.StatusOK, response)
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+// bookSlotBody books users on date at slot for an hour
+func bookSlotBody(users []int, date, slot string) gin.H {
+	return gin.H{
+		"user_ids":           users,
+		"date":               date,
+		"slot":               slot,
+		"slot_lookup_config": gin.H{"duration_minutes": 60, "search_every": 60},
+	}
+}
+
+// slotStarts returns the start of slots, as listed in a response
+func slotStarts(slots any) []string {
+	var starts []string
+	found, _ := slots.([]any)
+	for _, slot := range found {
+		starts = append(starts, slot.(map[string]any)["start"].(string))
+	}
+	return starts
+}
+
+// lookupSlots looks slots up with body and returns the start of the ones
+// found, along with the response
+func lookupSlots(t *testing.T, r http.Handler, body gin.H) ([]string, map[string]any) {
+	t.Helper()
+	status, response := request(t, r, http.MethodPost, "/v1/user/find-available-slots", body)
+	expectStatus(t, "find-available-slots", status, http.StatusOK, response)
+	return slotStarts(response["slots"]), response
+}
+
+// findSlots returns the start of the hour long slots free for users on date,
+// in order
+func findSlots(t *testing.T, r http.Handler, users []int, date string) []string {
+	t.Helper()
+	slots, _ := lookupSlots(t, r, bookSlotBody(users, date, ""))
+	return slots
+}
+
+func TestMultipleAvailabilityWindows(t *testing.T) {
+	r := newTestServer(t)
+	users := []int{mustCreateUser(t, r, "alice"), mustCreateUser(t, r, "bob")}
+	for _, window := range [][2]int{{9, 12}, {14, 18}} {
+		status, response := addWindow(t, r, users[0], "tuesday", window[0], window[1])
+		expectStatus(t, "set-availability", status, http.StatusOK, response)
+	}
+	status, response := addWindow(t, r, users[1], "tuesday", 8, 20)
+	expectStatus(t, "set-availability", status, http.StatusOK, response)
+
+	// windows of a weekday can't overlap, even partly
+	for _, window := range [][2]int{{11, 15}, {9, 12}, {15, 16}} {
+		status, response := addWindow(t, r, users[0], "tuesday", window[0], window[1])
+		expectStatus(t, fmt.Sprintf("set-availability %v", window), status, http.StatusBadRequest, response)
+	}
+	// nor can a window end before it starts
+	status, response = addWindow(t, r, users[0], "wednesday", 12, 9)
+	expectStatus(t, "set-availability 12-9", status, http.StatusBadRequest, response)
+
+	expected := []string{"09:00", "10:00", "11:00", "14:00", "15:00", "16:00", "17:00"}
+	if slots := findSlots(t, r, users, testDate(1)); !slices.Equal(slots, expected) {
+		t.Fatalf("expected the slots of both windows %v, got %v", expected, slots)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "15:00"))
+	expectStatus(t, "book-slot 15:00", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "12:00"))
+	if status == http.StatusOK {
+		t.Fatalf("book-slot 12:00, between the windows: %v", response)
+	}
+}
+
+// conflictIDs returns the ids of the bookings listed as conflicts, in order
+func conflictIDs(response map[string]any) []int {
+	var ids []int
+	for _, conflict := range response["conflicts"].([]any) {
+		ids = append(ids, int(conflict.(map[string]any)["id"].(float64)))
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestUpdateAndDeleteAvailability(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	for _, slot := range []string{"10:00", "15:00"} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), slot))
+		expectStatus(t, "book-slot "+slot, status, http.StatusOK, response)
+	}
+
+	// overlapping windows are rejected as a whole
+	status, response := request(t, r, http.MethodPut, "/v1/user/availability", gin.H{
+		"user_id": strconv.Itoa(users[0]),
+		"day":     "tuesday",
+		"windows": []gin.H{
+			{"start_time_hour": 9, "start_time_minutes": 0, "end_time_hour": 12, "end_time_minutes": 0},
+			{"start_time_hour": 11, "start_time_minutes": 0, "end_time_hour": 13, "end_time_minutes": 0},
+		},
+	})
+	expectStatus(t, "availability with overlapping windows", status, http.StatusBadRequest, response)
+
+	// moving tuesday to the afternoon leaves the morning booking out
+	status, response = request(t, r, http.MethodPut, "/v1/user/availability", gin.H{
+		"user_id": strconv.Itoa(users[0]),
+		"day":     "tuesday",
+		"windows": []gin.H{{"start_time_hour": 13, "start_time_minutes": 0, "end_time_hour": 17, "end_time_minutes": 0}},
+	})
+	expectStatus(t, "availability", status, http.StatusOK, response)
+	if ids := conflictIDs(response); !slices.Equal(ids, []int{1}) {
+		t.Errorf("expected the morning booking to conflict, got %v", ids)
+	}
+	expected := []string{"13:00", "14:00", "16:00"}
+	if slots := findSlots(t, r, users, testDate(1)); !slices.Equal(slots, expected) {
+		t.Errorf("expected the afternoon slots %v, got %v", expected, slots)
+	}
+
+	status, response = request(t, r, http.MethodDelete, "/v1/user/availability", gin.H{
+		"user_id": strconv.Itoa(users[0]),
+		"day":     "tuesday",
+	})
+	expectStatus(t, "delete availability", status, http.StatusOK, response)
+	if ids := conflictIDs(response); !slices.Equal(ids, []int{1, 2}) {
+		t.Errorf("expected both bookings to conflict, got %v", ids)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "13:00"))
+	if status == http.StatusOK {
+		t.Errorf("book-slot on a cleared tuesday: %v", response)
+	}
+	// the other weekdays are left as they are
+	if slots := findSlots(t, r, users, testDate(2)); len(slots) != 8 {
+		t.Errorf("expected 8 slots on wednesday, got %v", slots)
+	}
+}
+
+func TestSetAvailabilityConcurrent(t *testing.T) {
+	r := newTestServer(t)
+	user := mustCreateUser(t, r, "busy")
+
+	// every one of these windows overlaps all the others
+	const windows = 20
+	statuses := make(chan int, windows)
+	var wg sync.WaitGroup
+	for i := 0; i < windows; i++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			status, _ := addWindow(t, r, user, "tuesday", start, 17)
+			statuses <- status
+		}(9 + i%4)
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusBadRequest] != windows-1 {
+		t.Fatalf("expected 1 window and %d overlaps, got %v", windows-1, counts)
+	}
+}
+
+// setOverride overrides the availability of user from start to end with
+// windows, time off when there are none
+func setOverride(t *testing.T, r http.Handler, user int, start, end string, windows ...[2]int) {
+	t.Helper()
+	body := gin.H{"user_id": strconv.Itoa(user), "start_date": start, "end_date": end, "windows": []gin.H{}}
+	for _, window := range windows {
+		body["windows"] = append(body["windows"].([]gin.H), gin.H{"start_time_hour": window[0], "start_time_minutes": 0, "end_time_hour": window[1], "end_time_minutes": 0})
+	}
+	status, response := request(t, r, http.MethodPost, "/v1/user/availability-override", body)
+	expectStatus(t, "availability-override", status, http.StatusOK, response)
+}
+
+func TestAvailabilityOverrides(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+
+	setOverride(t, r, users[0], testDate(1), testDate(1), [2]int{10, 12}, [2]int{15, 16})
+	expected := []string{"10:00", "11:00", "15:00"}
+	if slots := findSlots(t, r, users, testDate(1)); !slices.Equal(slots, expected) {
+		t.Errorf("expected the override's slots %v, got %v", expected, slots)
+	}
+
+	// time off from wednesday to thursday, friday is left as it is
+	setOverride(t, r, users[1], testDate(2), testDate(3))
+	for _, date := range []string{testDate(2), testDate(3)} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, date, "10:00"))
+		if status == http.StatusOK {
+			t.Errorf("book-slot on %s, during time off: %v", date, response)
+		}
+	}
+	if slots := findSlots(t, r, users, testDate(4)); len(slots) != 8 {
+		t.Errorf("expected 8 slots on friday, got %v", slots)
+	}
+
+	// invalid ranges and windows
+	for _, body := range []gin.H{
+		{"user_id": strconv.Itoa(users[0]), "start_date": testDate(3), "end_date": testDate(2)},
+		{"user_id": strconv.Itoa(users[0]), "start_date": "tomorrow"},
+		{"user_id": strconv.Itoa(users[0]), "start_date": testDate(1), "windows": []gin.H{
+			{"start_time_hour": 10, "start_time_minutes": 0, "end_time_hour": 12, "end_time_minutes": 0},
+			{"start_time_hour": 11, "start_time_minutes": 0, "end_time_hour": 13, "end_time_minutes": 0},
+		}},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/availability-override", body)
+		expectStatus(t, fmt.Sprintf("availability-override %v", body), status, http.StatusBadRequest, response)
+	}
+
+	// dropping the overrides brings the weekly windows back
+	for _, user := range users {
+		status, response := request(t, r, http.MethodDelete, "/v1/user/availability-override", gin.H{
+			"user_id":    strconv.Itoa(user),
+			"start_date": testDate(0),
+			"end_date":   testDate(6),
+		})
+		expectStatus(t, "delete availability-override", status, http.StatusOK, response)
+	}
+	for _, date := range []string{testDate(1), testDate(2)} {
+		if slots := findSlots(t, r, users, date); len(slots) != 8 {
+			t.Errorf("expected 8 slots on %s, got %v", date, slots)
+		}
+	}
+}
+
+func TestOverlappingOverrides(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	expectSlots := func(date string, expected ...string) {
+		t.Helper()
+		if slots := findSlots(t, r, users, date); !slices.Equal(slots, expected) {
+			t.Errorf("%s: expected the slots %v, got %v", date, expected, slots)
+		}
+	}
+	all := []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00"}
+
+	// the latest override of a date wins, windows aren't added up
+	setOverride(t, r, users[0], testDate(0), testDate(6), [2]int{9, 12})
+	setOverride(t, r, users[0], testDate(2), testDate(2), [2]int{14, 16})
+	expectSlots(testDate(1), "09:00", "10:00", "11:00")
+	expectSlots(testDate(2), "14:00", "15:00")
+	expectSlots(testDate(3), "09:00", "10:00", "11:00")
+	setOverride(t, r, users[0], testDate(4), testDate(5))
+	setOverride(t, r, users[0], testDate(5), testDate(5), [2]int{10, 11})
+	expectSlots(testDate(4))
+	expectSlots(testDate(5), "10:00")
+
+	// clearing a range cuts down the overrides overlapping it
+	status, response := request(t, r, http.MethodDelete, "/v1/user/availability-override", gin.H{
+		"user_id":    strconv.Itoa(users[0]),
+		"start_date": testDate(1),
+		"end_date":   testDate(2),
+	})
+	expectStatus(t, "delete availability-override", status, http.StatusOK, response)
+	if response["deleted"] != float64(2) {
+		t.Errorf("expected the week and the day overrides to be cut, got %v", response)
+	}
+	expectSlots(testDate(0), "09:00", "10:00", "11:00")
+	expectSlots(testDate(1), all...)
+	expectSlots(testDate(2), all...)
+	expectSlots(testDate(3), "09:00", "10:00", "11:00")
+	expectSlots(testDate(4))
+	expectSlots(testDate(5), "10:00")
+	expectSlots(testDate(6), "09:00", "10:00", "11:00")
+
+	// overrides stored overlapping each other, the latest one still wins
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, override := range []struct {
+		start, end int
+		hours      [2]int
+	}{{8, 10, [2]int{9, 10}}, {9, 11, [2]int{15, 16}}} {
+		if _, err := db.Exec(insertAvailabilityOverride, users[1], testDate(override.start), testDate(override.end), true, override.hours[0], 0, override.hours[1], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectSlots(testDate(8), "09:00")
+	expectSlots(testDate(9), "15:00")
+	expectSlots(testDate(11), "15:00")
+}
+
+func TestCrossZoneSlots(t *testing.T) {
+	r := newTestServer(t)
+	status, response := request(t, r, http.MethodPost, "/v1/create-user", gin.H{"name": "alice", "time_zone": "Mars/Olympus"})
+	expectStatus(t, "create-user in an unknown zone", status, http.StatusBadRequest, response)
+	users := createUsers(t, r, 2)
+	status, response = request(t, r, http.MethodPost, "/v1/user/set-time-zone", gin.H{"user_id": users[0], "time_zone": "Asia/Kolkata"})
+	expectStatus(t, "set-time-zone", status, http.StatusOK, response)
+
+	// 09:00-17:00 in Kolkata is 03:30-11:30 UTC, both are free from 09:00
+	// to 11:30 UTC, slots are in the zone of the first user
+	body := bookSlotBody(users, testDate(1), "")
+	body["slot_lookup_config"] = gin.H{"slot_duration": "hourly", "search_every": 30}
+	for _, lookup := range []struct {
+		first, second int
+		zone          string
+		slots         []string
+	}{
+		{users[0], users[1], "Asia/Kolkata", []string{"14:30", "15:00", "15:30", "16:00"}},
+		{users[1], users[0], "UTC", []string{"09:00", "09:30", "10:00", "10:30"}},
+	} {
+		body["user_ids"] = []int{lookup.first, lookup.second}
+		slots, response := lookupSlots(t, r, body)
+		if response["time_zone"] != lookup.zone || !slices.Equal(slots, lookup.slots) {
+			t.Errorf("user %d: expected %v in %s, got %v in %v", lookup.first, lookup.slots, lookup.zone, slots, response["time_zone"])
+		}
+	}
+
+	// booked at 15:00 in Kolkata, bob sees it at 09:30
+	body["user_ids"], body["slot"] = users, "15:00"
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": users[1], "date": testDate(1)})
+	expectStatus(t, "view-schedule", status, http.StatusOK, response)
+	if booked := slotStarts(response["booked_slots"]); !slices.Equal(booked, []string{"09:30"}) || response["time_zone"] != "UTC" {
+		t.Errorf("expected a booking at 09:30 UTC, got %v", response)
+	}
+}
+
+func TestDaylightSavingSlots(t *testing.T) {
+	r := newTestServer(t)
+	now = func() time.Time { return time.Date(2030, time.March, 1, 8, 0, 0, 0, time.UTC) }
+	var users []int
+	for _, name := range []string{"alice", "bob"} {
+		status, response := request(t, r, http.MethodPost, "/v1/create-user", gin.H{"name": name, "time_zone": "America/New_York"})
+		expectStatus(t, "create-user", status, http.StatusOK, response)
+		user := int(response["id"].(float64))
+		for _, day := range dayOfTheWeekMap {
+			status, response := addWindow(t, r, user, day, 1, 5)
+			expectStatus(t, "set-availability", status, http.StatusOK, response)
+		}
+		users = append(users, user)
+	}
+
+	// the clocks skip from 02:00 to 03:00, there is no 02:00 slot
+	springForward := "2030-03-10"
+	if slots := findSlots(t, r, users, springForward); !slices.Equal(slots, []string{"01:00", "03:00", "04:00"}) {
+		t.Errorf("expected 01:00, 03:00 and 04:00 on %s, got %v", springForward, slots)
+	}
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, springForward, "02:00"))
+	expectStatus(t, "book-slot at a skipped time", status, http.StatusConflict, response)
+
+	// the clocks go back from 02:00 to 01:00, 01:00 happens twice
+	fallBack := "2030-11-03"
+	slots, response := lookupSlots(t, r, bookSlotBody(users, fallBack, ""))
+	if !slices.Equal(slots, []string{"01:00", "01:00", "02:00", "03:00", "04:00"}) {
+		t.Fatalf("expected 01:00 twice on %s, got %v", fallBack, slots)
+	}
+	var timestamps []string
+	for _, slot := range response["slots"].([]any) {
+		timestamps = append(timestamps, slot.(map[string]any)["timestamp"].(string))
+	}
+	if timestamps[0] != fallBack+"T01:00:00-04:00" || timestamps[1] != fallBack+"T01:00:00-05:00" {
+		t.Errorf("expected 01:00 before and after the clocks go back, got %v", timestamps)
+	}
+
+	// 01:00 is the earlier one, the later one is booked by its timestamp
+	for _, slot := range []string{"01:00", timestamps[1]} {
+		status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, fallBack, slot))
+		expectStatus(t, "book-slot at "+slot, status, http.StatusOK, response)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, fallBack, timestamps[1]))
+	expectStatus(t, "book-slot twice", status, http.StatusConflict, response)
+	if slots := findSlots(t, r, users, fallBack); !slices.Equal(slots, []string{"02:00", "03:00", "04:00"}) {
+		t.Errorf("expected both 01:00 slots booked, got %v", slots)
+	}
+
+	// the caller reads the date and the slots in their own time zone
+	body := bookSlotBody(users, fallBack, "")
+	body["time_zone"] = "UTC"
+	slots, response = lookupSlots(t, r, body)
+	if !slices.Equal(slots, []string{"07:00", "08:00", "09:00"}) || response["time_zone"] != "UTC" {
+		t.Errorf("expected 07:00, 08:00 and 09:00 UTC, got %v in %v", slots, response["time_zone"])
+	}
+	body["time_zone"] = "Mars/Olympus"
+	status, response = request(t, r, http.MethodPost, "/v1/user/find-available-slots", body)
+	expectStatus(t, "find-available-slots in an unknown zone", status, http.StatusBadRequest, response)
+}
+
+func TestCancelSlot(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	booking := response["id"]
+
+	status, response = request(t, r, http.MethodPost, "/v1/user/cancel-slot", gin.H{"booking_id": booking, "reason": "conflict"})
+	expectStatus(t, "cancel-slot", status, http.StatusOK, response)
+	// cancelled once only, unknown bookings can't be
+	for _, id := range []any{booking, 42} {
+		status, response = request(t, r, http.MethodPost, "/v1/user/cancel-slot", gin.H{"booking_id": id})
+		expectStatus(t, fmt.Sprintf("cancel-slot %v", id), status, http.StatusBadRequest, response)
+	}
+
+	// the booking is kept, out of the schedule, and its slot is free again
+	status, response = request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": users[0], "date": testDate(1)})
+	expectStatus(t, "view-schedule", status, http.StatusOK, response)
+	if booked := response["booked_slots"].([]any); len(booked) != 0 {
+		t.Errorf("expected no booked slot, got %v", booked)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot again", status, http.StatusOK, response)
+	if response["id"] == booking {
+		t.Errorf("expected a new booking, got %v", response["id"])
+	}
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var reason string
+	if err := db.QueryRow("SELECT cancellation_reason FROM calendar_user_booked_slots WHERE id = ? AND cancelled_at IS NOT NULL", booking).Scan(&reason); err != nil || reason != "conflict" {
+		t.Errorf("expected the cancelled booking to be kept with its reason, got %q %v", reason, err)
+	}
+}
+
+// rescheduleBody moves booking to date at slot
+func rescheduleBody(booking any, date, slot string) gin.H {
+	return gin.H{
+		"booking_id":         booking,
+		"date":               date,
+		"slot":               slot,
+		"slot_lookup_config": gin.H{"search_every": 30},
+	}
+}
+
+func TestRescheduleSlot(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	var bookings []any
+	for _, slot := range []string{"10:00", "14:00"} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), slot))
+		expectStatus(t, "book-slot "+slot, status, http.StatusOK, response)
+		bookings = append(bookings, response["id"])
+	}
+
+	// the booking doesn't block its own move half an hour later
+	status, response := request(t, r, http.MethodPost, "/v1/user/reschedule-slot", rescheduleBody(bookings[0], testDate(1), "10:30"))
+	expectStatus(t, "reschedule-slot 10:30", status, http.StatusOK, response)
+	if response["id"] != bookings[0] || response["starts_at"] != testDate(1)+"T10:30:00Z" || response["ends_at"] != testDate(1)+"T11:30:00Z" {
+		t.Errorf("unexpected reschedule %v", response)
+	}
+
+	// onto the other booking or out of the availability, it is left
+	// where it is
+	for _, slot := range []string{"14:00", "16:30"} {
+		status, response = request(t, r, http.MethodPost, "/v1/user/reschedule-slot", rescheduleBody(bookings[0], testDate(1), slot))
+		if status == http.StatusOK {
+			t.Errorf("reschedule-slot %s: %v", slot, response)
+		}
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/reschedule-slot", rescheduleBody(bookings[0], testDate(2), "09:00"))
+	expectStatus(t, "reschedule-slot to wednesday", status, http.StatusOK, response)
+
+	status, response = request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": users[1], "date": testDate(1)})
+	expectStatus(t, "view-schedule", status, http.StatusOK, response)
+	if booked := slotStarts(response["booked_slots"]); !slices.Equal(booked, []string{"14:00"}) {
+		t.Errorf("expected the 14:00 booking only on tuesday, got %v", booked)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": users[1], "date": testDate(2)})
+	expectStatus(t, "view-schedule", status, http.StatusOK, response)
+	if booked := slotStarts(response["booked_slots"]); !slices.Equal(booked, []string{"09:00"}) {
+		t.Errorf("expected the moved booking on wednesday, got %v", booked)
+	}
+
+	// cancelled bookings stay where they are
+	status, response = request(t, r, http.MethodPost, "/v1/user/cancel-slot", gin.H{"booking_id": bookings[1]})
+	expectStatus(t, "cancel-slot", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/reschedule-slot", rescheduleBody(bookings[1], testDate(2), "14:00"))
+	expectStatus(t, "reschedule-slot of a cancelled booking", status, http.StatusBadRequest, response)
+
+	// the new slot is checked as a booking is, the moved booking not
+	// counting towards the caps
+	status, response = request(t, r, http.MethodPost, "/v1/user/set-meeting-caps", gin.H{"user_id": users[0], "max_meetings_per_day": 1})
+	expectStatus(t, "set-meeting-caps", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(3), "10:00"))
+	expectStatus(t, "book-slot on thursday", status, http.StatusOK, response)
+	for _, move := range []struct {
+		date, slot string
+		status     int
+		code       any
+		startsAt   string
+	}{
+		{testDate(2), "11:00", http.StatusOK, nil, testDate(2) + "T11:00:00Z"},
+		{testDate(2), testDate(2) + "T16:30:00+05:30", http.StatusOK, nil, testDate(2) + "T11:00:00Z"},
+		{testDate(2), "11:10", http.StatusConflict, nil, ""},
+		{testDate(2), "16:30", http.StatusConflict, nil, ""},
+		{testDate(3), "14:00", http.StatusConflict, "daily_cap_reached", ""},
+		{testDate(4), "14:00", http.StatusOK, nil, testDate(4) + "T14:00:00Z"},
+	} {
+		status, response = request(t, r, http.MethodPost, "/v1/user/reschedule-slot", rescheduleBody(bookings[0], move.date, move.slot))
+		what := fmt.Sprintf("reschedule-slot %s %s", move.date, move.slot)
+		expectStatus(t, what, status, move.status, response)
+		if response["code"] != move.code || (move.startsAt != "" && response["starts_at"] != move.startsAt) {
+			t.Errorf("%s: unexpected response %v", what, response)
+		}
+	}
+}
+
+func TestBookSlotConcurrent(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+
+	// every one of these hour long slots overlaps all the others
+	slots := []string{"10:00", "10:15", "10:30", "10:45"}
+	const bookings = 20
+	statuses := make(chan int, bookings)
+	var wg sync.WaitGroup
+	for i := 0; i < bookings; i++ {
+		wg.Add(1)
+		go func(slot string) {
+			defer wg.Done()
+			body := bookSlotBody(users, testDate(1), slot)
+			body["slot_lookup_config"] = gin.H{"slot_duration": "hourly", "search_every": 15}
+			status, _ := request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+			statuses <- status
+		}(slots[i%len(slots)])
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != bookings-1 {
+		t.Fatalf("expected 1 booking and %d conflicts, got %v", bookings-1, counts)
+	}
+
+	for _, user := range users {
+		status, response := request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": user, "date": testDate(1)})
+		expectStatus(t, "view-schedule", status, http.StatusOK, response)
+		if booked := response["booked_slots"].([]any); len(booked) != 1 {
+			t.Fatalf("user %d: expected 1 booked slot, got %v", user, booked)
+		}
+	}
+}
+
+func TestBookSlotBusy(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+
+	// another writer holds the database past the busy timeout
+	file = strings.Replace(file, "_busy_timeout=5000", "_busy_timeout=100", 1)
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot while the database is locked", status, http.StatusConflict, response)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+}
+
+func TestOverlappingSlotsConflict(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 3)
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users[:2], testDate(1), "14:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+
+	// hour long slots every half an hour, the ones across 14:00-15:00 are gone
+	body := bookSlotBody(users[1:], testDate(1), "")
+	body["slot_lookup_config"] = gin.H{"slot_duration": "hourly", "search_every": 30}
+	slots, _ := lookupSlots(t, r, body)
+	expected := []string{"09:00", "09:30", "10:00", "10:30", "11:00", "11:30", "12:00", "12:30", "13:00", "15:00", "15:30", "16:00"}
+	if !slices.Equal(slots, expected) {
+		t.Errorf("expected %v, got %v", expected, slots)
+	}
+
+	for _, booking := range []struct {
+		slot     string
+		duration string
+		status   int
+	}{
+		{"13:30", "hourly", http.StatusConflict},
+		{"14:30", "half-hourly", http.StatusConflict},
+		{"13:30", "half-hourly", http.StatusOK},
+		{"15:00", "hourly", http.StatusOK},
+	} {
+		body := bookSlotBody(users[1:], testDate(1), booking.slot)
+		body["slot_lookup_config"] = gin.H{"slot_duration": booking.duration, "search_every": 30}
+		status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+		expectStatus(t, fmt.Sprintf("book-slot %s %s", booking.duration, booking.slot), status, booking.status, response)
+	}
+}
+
+func TestMeetingDurations(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+
+	// lookup returns the slots of a meeting of minutes, every 15 minutes
+	lookup := func(minutes int) (int, []string) {
+		t.Helper()
+		body := bookSlotBody(users, testDate(1), "")
+		body["slot_lookup_config"] = gin.H{"duration_minutes": minutes, "search_every": 15}
+		status, response := request(t, r, http.MethodPost, "/v1/user/find-available-slots", body)
+		return status, slotStarts(response["slots"])
+	}
+
+	for _, minutes := range []int{10, 241} {
+		if status, _ := lookup(minutes); status != http.StatusBadRequest {
+			t.Errorf("%d minutes: expected 400, got %d", minutes, status)
+		}
+	}
+	// a 90 minutes meeting fits until 15:30 in 09:00-17:00
+	if _, slots := lookup(90); len(slots) != 27 || slots[0] != "09:00" || slots[len(slots)-1] != "15:30" {
+		t.Errorf("expected 27 slots from 09:00 to 15:30, got %v", slots)
+	}
+
+	body := bookSlotBody(users, testDate(1), "10:00")
+	body["slot_lookup_config"] = gin.H{"duration_minutes": 45, "search_every": 15}
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	// the meeting takes 10:00-10:45, a 30 minutes one fits right after it
+	_, slots := lookup(30)
+	for _, slot := range []string{"09:15", "09:30", "10:45"} {
+		if !slices.Contains(slots, slot) {
+			t.Errorf("expected %s in %v", slot, slots)
+		}
+	}
+	for _, slot := range []string{"09:45", "10:00", "10:30"} {
+		if slices.Contains(slots, slot) {
+			t.Errorf("expected %s to be booked, got %v", slot, slots)
+		}
+	}
+
+	// the bounds come from the environment
+	least, most := minSlotDuration, maxSlotDuration
+	t.Cleanup(func() {
+		minSlotDuration, maxSlotDuration = least, most
+	})
+	t.Setenv("MIN_SLOT_DURATION_MINUTES", "5")
+	t.Setenv("MAX_SLOT_DURATION_MINUTES", "480")
+	initialize()
+	for _, minutes := range []int{10, 300} {
+		if status, _ := lookup(minutes); status != http.StatusOK {
+			t.Errorf("%d minutes within the bounds of the environment: got %d", minutes, status)
+		}
+	}
+}
+
+func TestMultiPartySlots(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 3)
+	status, response := request(t, r, http.MethodPut, "/v1/user/availability", gin.H{
+		"user_id": strconv.Itoa(users[2]),
+		"day":     "tuesday",
+		"windows": []gin.H{{"start_time_hour": 13, "start_time_minutes": 0, "end_time_hour": 15, "end_time_minutes": 0}},
+	})
+	expectStatus(t, "availability", status, http.StatusOK, response)
+
+	if slots := findSlots(t, r, users, testDate(1)); !slices.Equal(slots, []string{"13:00", "14:00"}) {
+		t.Errorf("expected the slots everyone is free at, got %v", slots)
+	}
+	// user_id_1 and user_id_2 still work, user_ids wins over them
+	body := bookSlotBody(users, testDate(1), "10:00")
+	delete(body, "user_ids")
+	body["user_id_1"], body["user_id_2"] = users[0], users[1]
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot with user_id_1 and user_id_2", status, http.StatusOK, response)
+	body["user_ids"], body["slot"] = users, "14:00"
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+
+	for _, user := range users {
+		status, response := request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": user, "date": testDate(1)})
+		expectStatus(t, "view-schedule", status, http.StatusOK, response)
+		booked := response["booked_slots"].([]any)
+		if user != users[2] && len(booked) != 2 || user == users[2] && len(booked) != 1 {
+			t.Errorf("user %d: unexpected booked slots %v", user, booked)
+		}
+	}
+	// the meeting of everyone blocks the slot for any of them
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users[1:], testDate(1), "14:00"))
+	expectStatus(t, "book-slot over the meeting", status, http.StatusConflict, response)
+
+	for _, ids := range [][]int{{users[0]}, {users[0], users[1], users[0]}, {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/find-available-slots", bookSlotBody(ids, testDate(1), ""))
+		expectStatus(t, fmt.Sprintf("find-available-slots %v", ids), status, http.StatusBadRequest, response)
+	}
+}
+
+func TestOptionalAttendees(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 5)
+	// the first optional user is free in the morning only, the second one
+	// has a meeting at 10:00
+	status, response := request(t, r, http.MethodPut, "/v1/user/availability", gin.H{
+		"user_id": strconv.Itoa(users[2]),
+		"day":     "tuesday",
+		"windows": []gin.H{{"start_time_hour": 9, "start_time_minutes": 0, "end_time_hour": 12, "end_time_minutes": 0}},
+	})
+	expectStatus(t, "availability", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users[3:], testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+
+	for _, lookup := range []struct {
+		quorum int
+		slots  []string
+	}{
+		{0, []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00"}},
+		{1, []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00"}},
+		{2, []string{"09:00", "11:00"}},
+	} {
+		body := bookSlotBody(users[:2], testDate(1), "")
+		body["optional_user_ids"], body["quorum"] = users[2:4], lookup.quorum
+		slots, response := lookupSlots(t, r, body)
+		if !slices.Equal(slots, lookup.slots) {
+			t.Errorf("quorum %d: expected %v, got %v", lookup.quorum, lookup.slots, slots)
+		}
+		expected := map[string][]any{"09:00": {float64(users[2]), float64(users[3])}, "10:00": {float64(users[2])}}
+		for _, slot := range response["slots"].([]any) {
+			slot := slot.(map[string]any)
+			free, _ := slot["optional_available"].([]any)
+			if expected, ok := expected[slot["start"].(string)]; ok && !slices.Equal(free, expected) {
+				t.Errorf("quorum %d: expected %v free at %s, got %v", lookup.quorum, expected, slot["start"], free)
+			}
+		}
+	}
+
+	for _, body := range []gin.H{
+		{"optional_user_ids": users[2:4], "quorum": 3},
+		{"optional_user_ids": users[1:3], "quorum": 1},
+	} {
+		lookup := bookSlotBody(users[:2], testDate(1), "")
+		for key, value := range body {
+			lookup[key] = value
+		}
+		status, response := request(t, r, http.MethodPost, "/v1/user/find-available-slots", lookup)
+		expectStatus(t, fmt.Sprintf("find-available-slots %v", body), status, http.StatusBadRequest, response)
+	}
+}
+
+// datedSlots returns the slots of a range or next lookup as "date start"
+func datedSlots(response map[string]any) []string {
+	var slots []string
+	for _, date := range response["dates"].([]any) {
+		date := date.(map[string]any)
+		for _, slot := range date["slots"].([]any) {
+			slots = append(slots, date["date"].(string)+" "+slot.(map[string]any)["start"].(string))
+		}
+	}
+	return slots
+}
+
+func TestSlotsOverRange(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	setOverride(t, r, users[0], testDate(1), testDate(1))
+	setOverride(t, r, users[1], testDate(2), testDate(2), [2]int{15, 17})
+
+	body := bookSlotBody(users, "", "")
+	body["from"], body["to"] = testDate(0), testDate(2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/find-available-slots", body)
+	expectStatus(t, "find-available-slots", status, http.StatusOK, response)
+	var expected []string
+	for _, slot := range []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00"} {
+		expected = append(expected, testDate(0)+" "+slot)
+	}
+	// the date off is left out
+	expected = append(expected, testDate(2)+" 15:00", testDate(2)+" 16:00")
+	if slots := datedSlots(response); !slices.Equal(slots, expected) {
+		t.Errorf("expected %v, got %v", expected, slots)
+	}
+
+	for _, lookup := range []gin.H{
+		{"from": testDate(2), "to": testDate(0)},
+		{"from": testDate(0), "to": testDate(31)},
+		{"from": testDate(0)},
+		{"next": -1},
+	} {
+		body := bookSlotBody(users, "", "")
+		delete(body, "date")
+		for key, value := range lookup {
+			body[key] = value
+		}
+		status, response := request(t, r, http.MethodPost, "/v1/user/find-available-slots", body)
+		expectStatus(t, fmt.Sprintf("find-available-slots %v", lookup), status, http.StatusBadRequest, response)
+	}
+}
+
+func TestNextAvailableSlots(t *testing.T) {
+	r := newTestServer(t)
+	// no weekly availability, only two dates ahead
+	users := []int{mustCreateUser(t, r, "alice"), mustCreateUser(t, r, "bob")}
+	for _, user := range users {
+		setOverride(t, r, user, testDate(1), testDate(1), [2]int{10, 12})
+		setOverride(t, r, user, testDate(3), testDate(3), [2]int{14, 17})
+	}
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "11:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+
+	body := bookSlotBody(users, "", "")
+	delete(body, "date")
+	body["next"] = 3
+	status, response = request(t, r, http.MethodPost, "/v1/user/find-available-slots", body)
+	expectStatus(t, "find-available-slots", status, http.StatusOK, response)
+	expected := []string{testDate(1) + " 10:00", testDate(3) + " 14:00", testDate(3) + " 15:00"}
+	if slots := datedSlots(response); !slices.Equal(slots, expected) {
+		t.Errorf("expected the next slots %v, got %v", expected, slots)
+	}
+}
+
+func TestStructuredSlots(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/set-time-zone", gin.H{"user_id": users[0], "time_zone": "Asia/Kolkata"})
+	expectStatus(t, "set-time-zone", status, http.StatusOK, response)
+
+	// both are free from 14:30 to 17:00 in Kolkata
+	body := bookSlotBody(users, testDate(1), "")
+	body["slot_lookup_config"] = gin.H{"duration_minutes": 45, "search_every": 30}
+	slots, response := lookupSlots(t, r, body)
+	expected := []string{"14:30", "15:00", "15:30", "16:00"}
+	if !slices.Equal(slots, expected) {
+		t.Fatalf("expected %v, got %v", expected, slots)
+	}
+	first := response["slots"].([]any)[0].(map[string]any)
+	if first["end"] != "15:15" || first["duration_minutes"] != float64(45) || first["timestamp"] != testDate(1)+"T14:30:00+05:30" {
+		t.Errorf("unexpected slot %v", first)
+	}
+
+	// the former format is still around
+	body["legacy_format"] = true
+	status, response = request(t, r, http.MethodPost, "/v1/user/find-available-slots", body)
+	expectStatus(t, "find-available-slots", status, http.StatusOK, response)
+	var legacy []string
+	for _, slot := range response["slots"].([]any) {
+		legacy = append(legacy, slot.(string))
+	}
+	if !slices.Equal(legacy, expected) {
+		t.Errorf("expected the legacy slots %v, got %v", expected, legacy)
+	}
+
+	// booked slots carry the booking id
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), expected[0]))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	booking := response["id"]
+	status, response = request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": users[1], "date": testDate(1)})
+	expectStatus(t, "view-schedule", status, http.StatusOK, response)
+	if booked := response["booked_slots"].([]any); len(booked) != 1 || booked[0].(map[string]any)["id"] != booking {
+		t.Errorf("expected booking %v, got %v", booking, booked)
+	}
+}
+
+func TestBufferTime(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 3)
+	status, response := request(t, r, http.MethodPost, "/v1/user/set-buffer", gin.H{"user_id": users[0], "buffer_before_minutes": 15, "buffer_after_minutes": 30})
+	expectStatus(t, "set-buffer", status, http.StatusOK, response)
+	for _, buffer := range []gin.H{
+		{"user_id": users[0], "buffer_before_minutes": -5},
+		{"user_id": users[0], "buffer_after_minutes": 121},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/set-buffer", buffer)
+		expectStatus(t, fmt.Sprintf("set-buffer %v", buffer), status, http.StatusBadRequest, response)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users[:2], testDate(1), "12:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+
+	// the first user keeps 30 minutes free after a meeting, so until 13:30,
+	// and before the next one, 10:45 would end too close to 12:00. The
+	// second one doesn't have buffers
+	for _, lookup := range []struct {
+		users []int
+		slots []string
+	}{
+		{[]int{users[0], users[2]}, []string{"10:30", "13:30", "13:45"}},
+		{[]int{users[1], users[2]}, []string{"10:30", "10:45", "11:00", "13:00", "13:15", "13:30", "13:45"}},
+	} {
+		body := bookSlotBody(lookup.users, testDate(1), "")
+		body["slot_lookup_config"] = gin.H{"duration_minutes": 60, "search_every": 15}
+		slots, _ := lookupSlots(t, r, body)
+		var around []string
+		for _, slot := range slots {
+			if slot >= "10:30" && slot <= "13:45" {
+				around = append(around, slot)
+			}
+		}
+		if !slices.Equal(around, lookup.slots) {
+			t.Errorf("users %v: expected %v around the booking, got %v", lookup.users, lookup.slots, around)
+		}
+	}
+
+	body := bookSlotBody([]int{users[0], users[2]}, testDate(1), "13:15")
+	body["slot_lookup_config"] = gin.H{"duration_minutes": 60, "search_every": 15}
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot within the buffer", status, http.StatusConflict, response)
+	body["slot"] = "13:30"
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot after the buffer", status, http.StatusOK, response)
+}
+
+func TestNoticeAndHorizon(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 3)
+	// testNow is monday 08:00, the first user takes 25 hours and a half of
+	// notice and is booked at most a week ahead
+	status, response := request(t, r, http.MethodPost, "/v1/user/set-notice", gin.H{"user_id": users[0], "min_notice_minutes": 25*60 + 30, "max_horizon_days": 7})
+	expectStatus(t, "set-notice", status, http.StatusOK, response)
+	for _, notice := range []gin.H{
+		{"user_id": users[0], "min_notice_minutes": -1},
+		{"user_id": users[0], "max_horizon_days": -1},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/set-notice", notice)
+		expectStatus(t, fmt.Sprintf("set-notice %v", notice), status, http.StatusBadRequest, response)
+	}
+
+	if slots := findSlots(t, r, users[:2], testDate(1)); len(slots) != 7 || slots[0] != "10:00" {
+		t.Errorf("expected the slots from 10:00 on tuesday, got %v", slots)
+	}
+	if slots := findSlots(t, r, users[:2], testDate(6)); len(slots) != 8 {
+		t.Errorf("expected every slot on sunday, got %v", slots)
+	}
+	// monday 09:00 is 7 days and an hour ahead
+	if slots := findSlots(t, r, users[:2], testDate(7)); len(slots) != 0 {
+		t.Errorf("expected no slot beyond the horizon, got %v", slots)
+	}
+	for _, booking := range []struct {
+		date, slot string
+		status     int
+	}{
+		{testDate(1), "09:00", http.StatusConflict},
+		{testDate(7), "09:00", http.StatusConflict},
+		{testDate(1), "10:00", http.StatusOK},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users[:2], booking.date, booking.slot))
+		expectStatus(t, fmt.Sprintf("book-slot %s %s", booking.date, booking.slot), status, booking.status, response)
+	}
+
+	// slots earlier today are gone, past dates are rejected
+	now = func() time.Time { return testNow.Add(4 * time.Hour) }
+	if slots := findSlots(t, r, users[1:], testDate(0)); !slices.Equal(slots, []string{"12:00", "13:00", "14:00", "15:00", "16:00"}) {
+		t.Errorf("expected the slots from noon, got %v", slots)
+	}
+	for _, path := range []string{"/v1/user/find-available-slots", "/v1/user/book-slot"} {
+		status, response := request(t, r, http.MethodPost, path, bookSlotBody(users[1:], testDate(-1), "10:00"))
+		expectStatus(t, path+" yesterday", status, http.StatusBadRequest, response)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": users[1], "date": testDate(-1)})
+	expectStatus(t, "view-schedule yesterday", status, http.StatusBadRequest, response)
+}
+
+func TestMeetingCaps(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 4)
+	for _, caps := range []gin.H{
+		{"user_id": users[0], "max_meetings_per_day": 2},
+		{"user_id": users[1], "max_minutes_per_week": 150},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/set-meeting-caps", caps)
+		expectStatus(t, "set-meeting-caps", status, http.StatusOK, response)
+	}
+	status, response := request(t, r, http.MethodPost, "/v1/user/set-meeting-caps", gin.H{"user_id": users[0], "max_meetings_per_week": -1})
+	expectStatus(t, "set-meeting-caps with a negative cap", status, http.StatusBadRequest, response)
+
+	for _, booking := range []struct {
+		users      []int
+		date, slot string
+		status     int
+		code       string
+	}{
+		// two meetings a day for the first user
+		{[]int{users[0], users[2]}, testDate(1), "09:00", http.StatusOK, ""},
+		{[]int{users[0], users[3]}, testDate(1), "11:00", http.StatusOK, ""},
+		{[]int{users[0], users[2]}, testDate(1), "14:00", http.StatusConflict, "daily_cap_reached"},
+		{[]int{users[0], users[2]}, testDate(2), "14:00", http.StatusOK, ""},
+		// two hours and a half a week for the second one, from monday to
+		// sunday
+		{[]int{users[1], users[2]}, testDate(0), "10:00", http.StatusOK, ""},
+		{[]int{users[1], users[3]}, testDate(3), "10:00", http.StatusOK, ""},
+		{[]int{users[1], users[3]}, testDate(6), "10:00", http.StatusConflict, "weekly_cap_reached"},
+		{[]int{users[1], users[3]}, testDate(7), "10:00", http.StatusOK, ""},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(booking.users, booking.date, booking.slot))
+		what := fmt.Sprintf("book-slot %v %s %s", booking.users, booking.date, booking.slot)
+		expectStatus(t, what, status, booking.status, response)
+		if booking.code != "" && response["code"] != booking.code {
+			t.Errorf("%s: expected %s, got %v", what, booking.code, response)
+		}
+	}
+
+	// slots going over a cap are not offered either
+	if slots := findSlots(t, r, []int{users[0], users[3]}, testDate(1)); len(slots) != 0 {
+		t.Errorf("expected no slot past the daily cap, got %v", slots)
+	}
+	if slots := findSlots(t, r, []int{users[1], users[2]}, testDate(5)); len(slots) != 0 {
+		t.Errorf("expected no slot past the weekly cap, got %v", slots)
+	}
+	// a half an hour meeting still fits in the week
+	body := bookSlotBody([]int{users[1], users[2]}, testDate(5), "")
+	body["slot_lookup_config"] = gin.H{"duration_minutes": 30, "search_every": 60}
+	if slots, _ := lookupSlots(t, r, body); len(slots) == 0 {
+		t.Errorf("expected the slots of a half an hour meeting, got none")
+	}
+}
+
+// failingLoadQuerier reads through db, the booked load lookups past the first
+// allowed ones fail, none of them do when allowed is negative
+type failingLoadQuerier struct {
+	*sql.DB
+	loads   int
+	allowed int
+}
+
+func (q *failingLoadQuerier) QueryRow(query string, args ...any) *sql.Row {
+	if query == getUserBookedLoad {
+		q.loads++
+		if q.allowed >= 0 && q.loads > q.allowed {
+			return q.DB.QueryRow("SELECT missing FROM nowhere")
+		}
+	}
+	return q.DB.QueryRow(query, args...)
+}
+
+func TestMeetingCapLookupError(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/set-meeting-caps", gin.H{"user_id": users[0], "max_meetings_per_day": 1})
+	expectStatus(t, "set-meeting-caps", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "09:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	date, _ := time.Parse("2006-01-02", testDate(1))
+	input := slotInput{UserIDs: users, SlotConfig: slotConfig{DurationMinutes: 60, Every: 60}}
+
+	// the lookups building the slots go through, the one telling the cap
+	// apart from a taken slot fails
+	q := &failingLoadQuerier{DB: db, allowed: -1}
+	if _, _, err := getSlotDiffs(q, input, date, 60, 0); err != nil {
+		t.Fatal(err)
+	}
+	q = &failingLoadQuerier{DB: db, allowed: q.loads}
+	if _, code, _, err := checkBookableSlot(q, input, users, date, "11:00", 0); err == nil {
+		t.Errorf("expected the failing cap lookup to be reported, got %q", code)
+	}
+	q = &failingLoadQuerier{DB: db, allowed: -1}
+	if _, code, user, err := checkBookableSlot(q, input, users, date, "11:00", 0); err != nil || code != dailyCapReached || user != users[0] {
+		t.Errorf("expected user %d to reach the daily cap, got %q for user %d: %v", users[0], code, user, err)
+	}
+}
+
+func TestRecurrenceRules(t *testing.T) {
+	for _, test := range []struct {
+		rule  string
+		start string
+		dates []string
+	}{
+		{"FREQ=DAILY;COUNT=3", "2027-01-30", []string{"2027-01-30", "2027-01-31", "2027-02-01"}},
+		{"FREQ=DAILY;INTERVAL=10;UNTIL=20270201", "2027-01-01", []string{"2027-01-01", "2027-01-11", "2027-01-21", "2027-01-31"}},
+		{"FREQ=WEEKLY;COUNT=3", "2027-01-05", []string{"2027-01-05", "2027-01-12", "2027-01-19"}},
+		{"FREQ=WEEKLY;BYDAY=MO,TH;COUNT=4", "2027-01-04", []string{"2027-01-04", "2027-01-07", "2027-01-11", "2027-01-14"}},
+		// the start doesn't count when it doesn't match BYDAY
+		{"FREQ=WEEKLY;BYDAY=FR;COUNT=2", "2027-01-04", []string{"2027-01-08", "2027-01-15"}},
+		{"FREQ=WEEKLY;INTERVAL=2;UNTIL=20270201", "2027-01-04", []string{"2027-01-04", "2027-01-18", "2027-02-01"}},
+		// months without a 31st are skipped
+		{"FREQ=MONTHLY;COUNT=4", "2027-01-31", []string{"2027-01-31", "2027-03-31", "2027-05-31", "2027-07-31"}},
+		{"RRULE:FREQ=MONTHLY;INTERVAL=3;UNTIL=20271231", "2027-01-15", []string{"2027-01-15", "2027-04-15", "2027-07-15", "2027-10-15"}},
+		{"FREQ=MONTHLY;BYDAY=1MO;COUNT=3", "2027-01-01", []string{"2027-01-04", "2027-02-01", "2027-03-01"}},
+		{"FREQ=MONTHLY;BYDAY=-1FR;COUNT=2", "2027-01-01", []string{"2027-01-29", "2027-02-26"}},
+		{"FREQ=YEARLY;COUNT=2", "2028-02-29", []string{"2028-02-29", "2032-02-29"}},
+		// a date-time UNTIL is compared with the start of the occurrences,
+		// a date one includes all of it
+		{"FREQ=DAILY;UNTIL=20270103T093000Z", "2027-01-01T10:00", []string{"2027-01-01T10:00", "2027-01-02T10:00"}},
+		{"FREQ=DAILY;UNTIL=20270103T100000", "2027-01-01T10:00", []string{"2027-01-01T10:00", "2027-01-02T10:00", "2027-01-03T10:00"}},
+		{"FREQ=DAILY;UNTIL=20270102", "2027-01-01T23:00", []string{"2027-01-01T23:00", "2027-01-02T23:00"}},
+		{"FREQ=MONTHLY;BYDAY=1MO;COUNT=2", "2027-01-01T09:30", []string{"2027-01-04T09:30", "2027-02-01T09:30"}},
+		// rules whose dates never match end with their UNTIL, or after
+		// maxRecurrenceYears
+		{"FREQ=DAILY;INTERVAL=7;BYDAY=MO;UNTIL=20270301", "2027-01-05", nil},
+		{"FREQ=DAILY;INTERVAL=7;BYDAY=MO;COUNT=2", "2027-01-05", nil},
+	} {
+		rule, err := parseRecurrence(test.rule, time.UTC)
+		if err != nil {
+			t.Errorf("%s: %v", test.rule, err)
+			continue
+		}
+		layout := "2006-01-02"
+		if len(test.start) > len(layout) {
+			layout = "2006-01-02T15:04"
+		}
+		start, _ := time.Parse(layout, test.start)
+		occurrences, err := rule.occurrences(start)
+		if err != nil {
+			t.Errorf("%s: %v", test.rule, err)
+			continue
+		}
+		var dates []string
+		for _, date := range occurrences {
+			dates = append(dates, date.Format(layout))
+		}
+		if !slices.Equal(dates, test.dates) {
+			t.Errorf("%s from %s: expected %v, got %v", test.rule, test.start, test.dates, dates)
+		}
+
+		// includes tells the same dates apart once the rule is bounded
+		bounded := rule.bounded(start)
+		var included []string
+		for day := start; day.Before(start.AddDate(5, 0, 0)); day = day.AddDate(0, 0, 1) {
+			if bounded.includes(start, day) {
+				included = append(included, day.Format(layout))
+			}
+		}
+		if !slices.Equal(included, test.dates) {
+			t.Errorf("%s from %s: expected %v to be included, got %v", test.rule, test.start, test.dates, included)
+		}
+	}
+
+	for _, invalid := range []string{"FREQ=HOURLY;COUNT=2", "FREQ=DAILY;COUNT=0", "FREQ=WEEKLY;BYDAY=XX;COUNT=2", "FREQ=DAILY;UNTIL=tomorrow", "FREQ=DAILY;UNTIL=20270101T25", "COUNT=2"} {
+		if _, err := parseRecurrence(invalid, time.UTC); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+	for _, unbounded := range []string{"FREQ=DAILY;COUNT=60", "FREQ=DAILY"} {
+		rule, err := parseRecurrence(unbounded, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rule.occurrences(testMonday); err == nil {
+			t.Errorf("%s: expected more than %d occurrences to be rejected", unbounded, maxOccurrences)
+		}
+	}
+}
+
+func TestRecurringBooking(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(15), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+
+	// the third tuesday is taken, nothing is booked
+	body := bookSlotBody(users, testDate(1), "10:00")
+	body["recurrence"] = "FREQ=WEEKLY;COUNT=3"
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot of a series", status, http.StatusConflict, response)
+	if conflicts := response["conflicts"].([]any); len(conflicts) != 1 || conflicts[0].(map[string]any)["date"] != testDate(15) || conflicts[0].(map[string]any)["code"] != "slot_unavailable" {
+		t.Errorf("expected the third tuesday to conflict, got %v", conflicts)
+	}
+	if slots := findSlots(t, r, users, testDate(1)); len(slots) != 8 {
+		t.Errorf("expected nothing booked, got the slots %v", slots)
+	}
+
+	body["recurrence"] = "FREQ=WEEKLY;INTERVAL=3;COUNT=3"
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot of a series", status, http.StatusOK, response)
+	occurrences := response["occurrences"].([]any)
+	if len(occurrences) != 3 || response["series_id"] == nil {
+		t.Fatalf("expected a series of 3 occurrences, got %v", response)
+	}
+	for i, occurrence := range occurrences {
+		if startsAt := occurrence.(map[string]any)["starts_at"]; startsAt != testDate(1+21*i)+"T10:00:00Z" {
+			t.Errorf("occurrence %d starts at %v", i, startsAt)
+		}
+	}
+
+	// a single occurrence, then the rest of the series
+	status, response = request(t, r, http.MethodPost, "/v1/user/cancel-slot", gin.H{"booking_id": occurrences[1].(map[string]any)["id"]})
+	expectStatus(t, "cancel-slot", status, http.StatusOK, response)
+	if slots := findSlots(t, r, users, testDate(22)); len(slots) != 8 {
+		t.Errorf("expected the cancelled occurrence to free its slot, got %v", slots)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/cancel-slot", gin.H{"booking_id": occurrences[0].(map[string]any)["id"], "series": true})
+	expectStatus(t, "cancel-slot of the series", status, http.StatusOK, response)
+	if response["cancelled"] != float64(2) {
+		t.Errorf("expected the 2 remaining occurrences to be cancelled, got %v", response)
+	}
+}
+
+func TestRecurringBookingCaps(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/set-meeting-caps", gin.H{"user_id": users[0], "max_meetings_per_week": 2})
+	expectStatus(t, "set-meeting-caps", status, http.StatusOK, response)
+
+	// the earlier occurrences count against the cap of the third one
+	body := bookSlotBody(users, testDate(1), "10:00")
+	body["recurrence"] = "FREQ=DAILY;COUNT=3"
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot of a series", status, http.StatusConflict, response)
+	conflicts := response["conflicts"].([]any)
+	if len(conflicts) != 1 || fmt.Sprint(conflicts[0]) != fmt.Sprint(map[string]any{"date": testDate(3), "code": "weekly_cap_reached", "user_id": float64(users[0])}) {
+		t.Errorf("expected the third occurrence to reach the weekly cap, got %v", conflicts)
+	}
+	if slots := findSlots(t, r, users, testDate(1)); len(slots) != 8 {
+		t.Errorf("expected nothing booked, got the slots %v", slots)
+	}
+
+	body["recurrence"] = "FREQ=DAILY;COUNT=2"
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot of a series", status, http.StatusOK, response)
+}
+
+func TestAvailabilityRules(t *testing.T) {
+	r := newTestServer(t)
+	user := mustCreateUser(t, r, "ruled")
+	users := append(createUsers(t, r, 1), user)
+	setRule := func(recurrence, start, end string, window [2]int) (int, map[string]any) {
+		return request(t, r, http.MethodPost, "/v1/user/availability-rule", gin.H{
+			"user_id":    strconv.Itoa(user),
+			"recurrence": recurrence,
+			"start_date": start,
+			"end_date":   end,
+			"windows":    []gin.H{{"start_time_hour": window[0], "start_time_minutes": 0, "end_time_hour": window[1], "end_time_minutes": 0}},
+		})
+	}
+	noAvailability := func(date string) {
+		t.Helper()
+		status, response := request(t, r, http.MethodPost, "/v1/user/find-available-slots", bookSlotBody(users, date, ""))
+		expectStatus(t, "find-available-slots on "+date, status, http.StatusBadRequest, response)
+	}
+
+	// every other friday for 4 weeks
+	status, response := setRule("FREQ=WEEKLY;INTERVAL=2;BYDAY=FR", testDate(4), testDate(32), [2]int{14, 16})
+	expectStatus(t, "availability-rule", status, http.StatusOK, response)
+	fortnightly := response["rule_ids"].([]any)[0]
+	if slots := findSlots(t, r, users, testDate(4)); !slices.Equal(slots, []string{"14:00", "15:00"}) {
+		t.Errorf("expected the rule's window, got %v", slots)
+	}
+	noAvailability(testDate(11))
+	if slots := findSlots(t, r, users, testDate(32)); !slices.Equal(slots, []string{"14:00", "15:00"}) {
+		t.Errorf("expected the rule's window on its end date, got %v", slots)
+	}
+	noAvailability(testDate(46))
+
+	// the first monday of the month
+	first := testMonday.AddDate(0, 1, 1-testMonday.Day())
+	for first.Weekday() != time.Monday {
+		first = first.AddDate(0, 0, 1)
+	}
+	status, response = setRule("FREQ=MONTHLY;BYDAY=1MO", testDate(0), "", [2]int{9, 11})
+	expectStatus(t, "availability-rule", status, http.StatusOK, response)
+	if slots := findSlots(t, r, users, first.Format("2006-01-02")); !slices.Equal(slots, []string{"09:00", "10:00"}) {
+		t.Errorf("expected the first monday of the month to be available, got %v", slots)
+	}
+	noAvailability(first.AddDate(0, 0, 7).Format("2006-01-02"))
+
+	// two wednesdays, and thursdays until 08:30 on the second one, which
+	// leaves its 09:00 window out
+	status, response = setRule("FREQ=WEEKLY;BYDAY=WE;COUNT=2", testDate(0), "", [2]int{9, 11})
+	expectStatus(t, "availability-rule", status, http.StatusOK, response)
+	until := strings.ReplaceAll(testDate(10), "-", "") + "T083000Z"
+	status, response = setRule("FREQ=WEEKLY;BYDAY=TH;UNTIL="+until, testDate(0), "", [2]int{9, 11})
+	expectStatus(t, "availability-rule", status, http.StatusOK, response)
+	for _, date := range []string{testDate(2), testDate(9), testDate(3)} {
+		if slots := findSlots(t, r, users, date); !slices.Equal(slots, []string{"09:00", "10:00"}) {
+			t.Errorf("expected the rule's window on %s, got %v", date, slots)
+		}
+	}
+	noAvailability(testDate(16))
+	noAvailability(testDate(10))
+
+	// weekly windows are merged with the rules
+	status, response = addWindow(t, r, user, dayOfTheWeekMap[time.Friday], 15, 17)
+	expectStatus(t, "set-availability", status, http.StatusOK, response)
+	if slots := findSlots(t, r, users, testDate(4)); !slices.Equal(slots, []string{"14:00", "15:00", "16:00"}) {
+		t.Errorf("expected the merged windows, got %v", slots)
+	}
+	if slots := findSlots(t, r, users, testDate(11)); !slices.Equal(slots, []string{"15:00", "16:00"}) {
+		t.Errorf("expected the weekly window alone, got %v", slots)
+	}
+
+	for _, body := range []gin.H{
+		{"user_id": strconv.Itoa(user), "recurrence": "FREQ=HOURLY", "start_date": testDate(0), "windows": []gin.H{{"start_time_hour": 9, "start_time_minutes": 0, "end_time_hour": 10, "end_time_minutes": 0}}},
+		{"user_id": strconv.Itoa(user), "recurrence": "FREQ=DAILY", "start_date": testDate(7), "end_date": testDate(0), "windows": []gin.H{{"start_time_hour": 9, "start_time_minutes": 0, "end_time_hour": 10, "end_time_minutes": 0}}},
+		{"user_id": strconv.Itoa(user), "recurrence": "FREQ=DAILY", "start_date": testDate(0)},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/availability-rule", body)
+		expectStatus(t, "invalid availability-rule", status, http.StatusBadRequest, response)
+	}
+
+	status, response = request(t, r, http.MethodDelete, "/v1/user/availability-rule", gin.H{"user_id": strconv.Itoa(user), "rule_id": fortnightly})
+	expectStatus(t, "delete availability-rule", status, http.StatusOK, response)
+	if slots := findSlots(t, r, users, testDate(4)); !slices.Equal(slots, []string{"15:00", "16:00"}) {
+		t.Errorf("expected the deleted rule's window to be gone, got %v", slots)
+	}
+	status, response = request(t, r, http.MethodDelete, "/v1/user/availability-rule", gin.H{"user_id": strconv.Itoa(user), "rule_id": fortnightly})
+	expectStatus(t, "delete of a deleted availability-rule", status, http.StatusBadRequest, response)
+}
+
+// fetch sends a GET request and returns the raw response
+func fetch(t *testing.T, r http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestCalendarExport(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	guest := mustCreateUser(t, r, "Lovelace, Ada \"the first\" with a name long enough to fold the line")
+	for _, day := range dayOfTheWeekMap {
+		status, response := addWindow(t, r, guest, day, 9, 17)
+		expectStatus(t, "set-availability", status, http.StatusOK, response)
+	}
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(append(users, guest), testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	booking := int(response["id"].(float64))
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(2), "14:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/cancel-slot", gin.H{"booking_id": response["id"]})
+	expectStatus(t, "cancel-slot", status, http.StatusOK, response)
+	now = func() time.Time { return testNow.Add(time.Hour) }
+	status, response = request(t, r, http.MethodPost, "/v1/user/reschedule-slot", rescheduleBody(booking, testDate(1), "11:00"))
+	expectStatus(t, "reschedule-slot", status, http.StatusOK, response)
+	now = func() time.Time { return testNow.Add(2 * time.Hour) }
+
+	w := fetch(t, r, fmt.Sprintf("/v1/user/%d/calendar.ics", users[1]))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("expected a calendar, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	feed := w.Body.String()
+	if !strings.HasPrefix(feed, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n") || !strings.HasSuffix(feed, "END:VCALENDAR\r\n") {
+		t.Errorf("expected a VCALENDAR with CRLF line endings, got %q", feed)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(feed, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("expected lines to be folded at 75 octets, got %q", line)
+		}
+	}
+	unfolded := strings.ReplaceAll(feed, "\r\n ", "")
+	if events := strings.Count(unfolded, "BEGIN:VEVENT"); events != 2 {
+		t.Errorf("expected 2 events, got %d", events)
+	}
+	start := strings.ReplaceAll(testDate(1), "-", "")
+	for _, line := range []string{
+		fmt.Sprintf("UID:booking-%d@calenderapi", booking),
+		"DTSTART:" + start + "T110000Z",
+		"DTEND:" + start + "T120000Z",
+		"DTSTAMP:" + testNow.Add(time.Hour).Format("20060102T150405Z"),
+		"DTSTAMP:" + testNow.Format("20060102T150405Z"),
+		"ORGANIZER;CN=\"user1\":mailto:user1@example.com",
+		"ATTENDEE;CN=\"user1\";ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED:mailto:user1@example.com",
+		fmt.Sprintf("ATTENDEE;CN=\"Lovelace, Ada the first with a name long enough to fold the line\";ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED:urn:calenderapi:user:%d", guest),
+		"SUMMARY:Meeting with user1\\, Lovelace\\, Ada \"the first\" with a name long enough to fold the line",
+		"STATUS:CONFIRMED",
+		"STATUS:CANCELLED",
+	} {
+		if !strings.Contains(unfolded, line+"\r\n") {
+			t.Errorf("expected the line %q in %q", line, unfolded)
+		}
+	}
+
+	if w := fetch(t, r, "/v1/user/999/calendar.ics"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown user, got %d", w.Code)
+	}
+}
+
+// icsDate formats the date days after testMonday, at hour UTC, as an
+// iCalendar date-time
+func icsDate(days, hour int) string {
+	return testMonday.AddDate(0, 0, days).Add(time.Duration(hour) * time.Hour).Format("20060102T150405Z")
+}
+
+// uploadCalendar uploads content as the external calendar of user
+func uploadCalendar(t *testing.T, r http.Handler, user int, content string) (int, map[string]any) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("user_id", strconv.Itoa(user))
+	part, err := form.CreateFormFile("file", "calendar.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/v1/user/external-calendar/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	response := make(map[string]any)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Errorf("upload: invalid response %q", w.Body.String())
+	}
+	return w.Code, response
+}
+
+func TestExternalCalendar(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	calendar := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"UID:standup",
+		"DTSTART:" + icsDate(1, 10),
+		"DTEND:" + icsDate(1, 11),
+		"RRULE:FREQ=DAILY;COUNT=3",
+		"EXDATE:" + icsDate(2, 10),
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:reminder",
+		"DTSTART:" + icsDate(1, 15),
+		"DTEND:" + icsDate(1, 16),
+		"TRANSP:TRANSPARENT",
+		"END:VEVENT",
+		"BEGIN:VFREEBUSY",
+		"FREEBUSY:" + icsDate(1, 14) + "/" + icsDate(1, 15),
+		"END:VFREEBUSY",
+		"END:VCALENDAR",
+		"",
+	}, "\r\n")
+	status, response := uploadCalendar(t, r, users[1], calendar)
+	expectStatus(t, "upload", status, http.StatusOK, response)
+	if response["events"] != float64(2) {
+		t.Errorf("expected the event and the busy period, got %v", response)
+	}
+
+	for _, test := range []struct {
+		days  int
+		slots []string
+	}{
+		{1, []string{"09:00", "11:00", "12:00", "13:00", "15:00", "16:00"}},
+		{2, []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00"}},
+		{3, []string{"09:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00"}},
+		{4, []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00"}},
+	} {
+		if slots := findSlots(t, r, users, testDate(test.days)); !slices.Equal(slots, test.slots) {
+			t.Errorf("%s: expected %v, got %v", testDate(test.days), test.slots, slots)
+		}
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "14:00"))
+	expectStatus(t, "book-slot over busy time", status, http.StatusConflict, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": users[1], "date": testDate(1)})
+	expectStatus(t, "view-schedule", status, http.StatusOK, response)
+	if busy := slotStarts(response["busy_slots"]); !slices.Equal(busy, []string{"10:00", "14:00"}) {
+		t.Errorf("expected the imported busy slots, got %v", busy)
+	}
+
+	// local files are read from ICS_IMPORT_DIR alone
+	dir := t.TempDir()
+	path := filepath.Join(dir, "calendar.ics")
+	status, response = request(t, r, http.MethodPost, "/v1/user/external-calendar", gin.H{"user_id": users[0], "path": path})
+	expectStatus(t, "external-calendar without an import directory", status, http.StatusForbidden, response)
+	importDir := calendarImportDir
+	t.Cleanup(func() { calendarImportDir = importDir })
+	calendarImportDir = dir
+
+	// a registered file is read again on every lookup
+	write := func(events ...string) {
+		content := "BEGIN:VCALENDAR\r\n" + strings.Join(events, "") + "END:VCALENDAR\r\n"
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("BEGIN:VEVENT\r\nUID:offsite\r\nDTSTART:" + icsDate(4, 9) + "\r\nDTEND:" + icsDate(4, 12) + "\r\nEND:VEVENT\r\n")
+	status, response = request(t, r, http.MethodPost, "/v1/user/external-calendar", gin.H{"user_id": users[0], "path": path})
+	expectStatus(t, "external-calendar", status, http.StatusOK, response)
+	registered := response["calendar_id"]
+	if slots := findSlots(t, r, users, testDate(4)); !slices.Equal(slots, []string{"12:00", "13:00", "14:00", "15:00", "16:00"}) {
+		t.Errorf("expected the registered calendar to be busy, got %v", slots)
+	}
+	write()
+	if slots := findSlots(t, r, users, testDate(4)); len(slots) != 8 {
+		t.Errorf("expected the changed file to be read again, got %v", slots)
+	}
+	write("BEGIN:VEVENT\r\nUID:offsite\r\nDTSTART:" + icsDate(3, 9) + "\r\nDTEND:" + icsDate(3, 17) + "\r\nEND:VEVENT\r\n")
+	status, response = request(t, r, http.MethodDelete, "/v1/user/external-calendar", gin.H{"user_id": users[0], "calendar_id": registered})
+	expectStatus(t, "delete external-calendar", status, http.StatusOK, response)
+	if slots := findSlots(t, r, users, testDate(3)); len(slots) != 7 {
+		t.Errorf("expected the deleted calendar to be ignored, got %v", slots)
+	}
+
+	outside := filepath.Join(t.TempDir(), "outside.ics")
+	if err := os.WriteFile(outside, []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.ics")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []gin.H{
+		{"user_id": users[0], "path": "calendar.ics"},
+		{"user_id": users[0], "path": filepath.Join(dir, "missing.ics")},
+		{"user_id": users[0], "path": outside},
+		{"user_id": users[0], "path": link},
+		{"user_id": users[0], "path": filepath.Join(dir, "..", filepath.Base(filepath.Dir(outside)), "outside.ics")},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/external-calendar", body)
+		expectStatus(t, "invalid external-calendar", status, http.StatusBadRequest, response)
+	}
+	status, response = uploadCalendar(t, r, users[0], "BEGIN:VEVENT\r\nDTSTART:tomorrow\r\nEND:VEVENT\r\n")
+	expectStatus(t, "upload of an invalid calendar", status, http.StatusBadRequest, response)
+}
+
+// caldavLogin generates the CalDAV password of user, it returns the
+// Authorization header signing in with it
+func caldavLogin(t *testing.T, r http.Handler, user int) string {
+	t.Helper()
+	status, response := request(t, r, http.MethodPost, "/v1/user/caldav-password", gin.H{"user_id": user})
+	expectStatus(t, "caldav-password", status, http.StatusOK, response)
+	credentials := fmt.Sprint(response["username"], ":", response["password"])
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+// davRequest sends a WebDAV request with its raw body and headers, signed in
+// with the auth Authorization header unless it's empty
+func davRequest(t *testing.T, r http.Handler, auth, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// caldavObject is a calendar object of one event on the date days after
+// testMonday, from hour start to hour end UTC, with the given attendees
+func caldavObject(uid string, days, start, end int, attendees ...int) string {
+	lines := []string{"BEGIN:VCALENDAR", "VERSION:2.0", "BEGIN:VEVENT", "UID:" + uid, "DTSTART:" + icsDate(days, start), "DTEND:" + icsDate(days, end), "SUMMARY:Lunch"}
+	for _, attendee := range attendees {
+		lines = append(lines, fmt.Sprintf("ATTENDEE:urn:calenderapi:user:%d", attendee))
+	}
+	lines = append(lines, "BEGIN:VALARM", "TRIGGER:-PT15M", "ACTION:DISPLAY", "DESCRIPTION:Lunch", "END:VALARM", "END:VEVENT", "END:VCALENDAR", "")
+	return strings.Join(lines, "\r\n")
+}
+
+func TestCalDAV(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	booking := fmt.Sprintf("booking-%d.ics", int(response["id"].(float64)))
+	collection := fmt.Sprintf("/v1/caldav/%d/", users[0])
+	owner, guest := caldavLogin(t, r, users[0]), caldavLogin(t, r, users[1])
+
+	w := davRequest(t, r, owner, "PROPFIND", collection, "", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<C:calendar/>") || !strings.Contains(w.Body.String(), collection+booking) || !strings.Contains(w.Body.String(), "getctag") {
+		t.Fatalf("expected the collection and its booking, got %d %s", w.Code, w.Body.String())
+	}
+	ctag := w.Body.String()
+	w = davRequest(t, r, owner, "PROPFIND", collection, `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getetag/></D:prop></D:propfind>`, map[string]string{"Depth": "0"})
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), booking) {
+		t.Errorf("expected the collection alone at depth 0, got %d %s", w.Code, w.Body.String())
+	}
+
+	// PUT of a new resource books it
+	w = davRequest(t, r, owner, http.MethodPut, collection+"lunch.ics", caldavObject("lunch-1", 1, 12, 13, users[1]), map[string]string{"If-None-Match": "*"})
+	if w.Code != http.StatusCreated || w.Header().Get("ETag") == "" {
+		t.Fatalf("expected the event to be booked, got %d %s", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if slots := findSlots(t, r, users, testDate(1)); !slices.Equal(slots, []string{"09:00", "11:00", "13:00", "14:00", "15:00", "16:00"}) {
+		t.Errorf("expected the event to be booked for both users, got %v", slots)
+	}
+	for _, test := range []struct {
+		what    string
+		name    string
+		event   string
+		headers map[string]string
+		status  int
+	}{
+		{"existing resource", "lunch.ics", caldavObject("lunch-1", 1, 14, 15, users[1]), map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed},
+		{"stale etag", "lunch.ics", caldavObject("lunch-1", 1, 14, 15, users[1]), map[string]string{"If-Match": `"stale"`}, http.StatusPreconditionFailed},
+		{"used UID", "other.ics", caldavObject("lunch-1", 2, 14, 15, users[1]), nil, http.StatusConflict},
+		{"booked slot", "other.ics", caldavObject("other", 1, 10, 11, users[1]), nil, http.StatusConflict},
+		{"outside availability", "other.ics", caldavObject("other", 1, 18, 19, users[1]), nil, http.StatusConflict},
+		{"recurring event", "other.ics", strings.Replace(caldavObject("other", 2, 14, 15, users[1]), "SUMMARY", "RRULE:FREQ=DAILY;COUNT=2\r\nSUMMARY", 1), nil, http.StatusBadRequest},
+		{"not a calendar", "other.ics", "BEGIN:VEVENT\r\nEND:VEVENT\r\n", nil, http.StatusBadRequest},
+		{"not an .ics", "other.txt", caldavObject("other", 2, 14, 15, users[1]), nil, http.StatusBadRequest},
+	} {
+		if w := davRequest(t, r, owner, http.MethodPut, collection+test.name, test.event, test.headers); w.Code != test.status {
+			t.Errorf("PUT of %s: expected %d, got %d %s", test.what, test.status, w.Code, w.Body.String())
+		}
+	}
+
+	// PUT of an existing resource moves it
+	w = davRequest(t, r, owner, http.MethodPut, collection+"lunch.ics", caldavObject("lunch-1", 1, 14, 15, users[1]), map[string]string{"If-Match": etag})
+	if w.Code != http.StatusNoContent || w.Header().Get("ETag") == etag {
+		t.Fatalf("expected the event to move, got %d %s", w.Code, w.Body.String())
+	}
+	if slots := findSlots(t, r, users, testDate(1)); !slices.Equal(slots, []string{"09:00", "11:00", "12:00", "13:00", "15:00", "16:00"}) {
+		t.Errorf("expected the event to be moved, got %v", slots)
+	}
+	w = davRequest(t, r, owner, http.MethodGet, collection+"lunch.ics", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "UID:lunch-1\r\n") || !strings.Contains(w.Body.String(), "DTSTART:"+icsDate(1, 14)) {
+		t.Errorf("expected the moved event, got %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(strings.ReplaceAll(w.Body.String(), "\r\n ", ""), "ATTENDEE;CN=\"user2\";ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED:mailto:user2@example.com\r\n") {
+		t.Errorf("expected the attendee to be addressed by email, got %s", w.Body.String())
+	}
+
+	// attendees can be named by email
+	dinner := strings.Replace(caldavObject("dinner-1", 3, 12, 13), "SUMMARY", "ATTENDEE:MAILTO:User2@Example.com\r\nSUMMARY", 1)
+	if w := davRequest(t, r, owner, http.MethodPut, collection+"dinner.ics", dinner, nil); w.Code != http.StatusCreated {
+		t.Fatalf("expected the event to be booked, got %d %s", w.Code, w.Body.String())
+	}
+	if slots := findSlots(t, r, users, testDate(3)); slices.Contains(slots, "12:00") {
+		t.Errorf("expected the event to be booked for both users, got %v", slots)
+	}
+
+	// events off the grid of book-slot are checked at their exact time
+	brunch := strings.NewReplacer("T100000Z", "T101000Z", "T110000Z", "T104000Z").Replace(caldavObject("brunch-1", 4, 10, 11, users[1]))
+	if w := davRequest(t, r, owner, http.MethodPut, collection+"brunch.ics", brunch, nil); w.Code != http.StatusCreated {
+		t.Fatalf("expected the event off the grid to be booked, got %d %s", w.Code, w.Body.String())
+	}
+	if slots := findSlots(t, r, users, testDate(4)); !slices.Equal(slots, []string{"09:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00"}) {
+		t.Errorf("expected the event off the grid to block 10:00, got %v", slots)
+	}
+	overlapping := strings.Replace(brunch, "brunch-1", "brunch-2", 1)
+	if w := davRequest(t, r, owner, http.MethodPut, collection+"brunch-2.ics", overlapping, nil); w.Code != http.StatusConflict {
+		t.Errorf("expected an overlapping event off the grid to conflict, got %d %s", w.Code, w.Body.String())
+	}
+	seconds := strings.NewReplacer("T130000Z", "T130030Z", "T140000Z", "T140030Z").Replace(caldavObject("brunch-3", 4, 13, 14, users[1]))
+	if w := davRequest(t, r, owner, http.MethodPut, collection+"brunch-3.ics", seconds, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an event starting between minutes to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+	w = davRequest(t, r, owner, "PROPFIND", collection, "", map[string]string{"Depth": "0"})
+	if w.Body.String() == ctag {
+		t.Errorf("expected the ctag to change")
+	}
+
+	query := func(days int) string {
+		return `<?xml version="1.0"?><C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><D:getetag/></D:prop><C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT"><C:time-range start="` + icsDate(days, 0) + `" end="` + icsDate(days+1, 0) + `"/></C:comp-filter></C:comp-filter></C:filter></C:calendar-query>`
+	}
+	w = davRequest(t, r, owner, "REPORT", collection, query(1), map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), collection+booking) || !strings.Contains(w.Body.String(), collection+"lunch.ics") {
+		t.Errorf("expected both events in the time range, got %d %s", w.Code, w.Body.String())
+	}
+	w = davRequest(t, r, owner, "REPORT", collection, query(2), map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), ".ics") {
+		t.Errorf("expected no event in the time range, got %d %s", w.Code, w.Body.String())
+	}
+	w = davRequest(t, r, owner, "REPORT", collection, `<?xml version="1.0"?><C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><C:calendar-data/></D:prop><D:href>`+collection+`lunch.ics</D:href><D:href>`+collection+`missing.ics</D:href></C:calendar-multiget>`, nil)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "UID:lunch-1") || !strings.Contains(w.Body.String(), "404 Not Found") {
+		t.Errorf("expected the event and a missing one, got %d %s", w.Code, w.Body.String())
+	}
+
+	// the attendee sees the event but can't move it
+	attendee := fmt.Sprintf("/v1/caldav/%d/", users[1])
+	if w := davRequest(t, r, guest, http.MethodPut, attendee+"lunch.ics", caldavObject("lunch-1", 1, 15, 16, users[0]), nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected an attendee not to move the event, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := davRequest(t, r, guest, http.MethodDelete, attendee+"lunch.ics", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected an attendee not to cancel the event, got %d %s", w.Code, w.Body.String())
+	}
+	if w := davRequest(t, r, owner, http.MethodDelete, collection+"lunch.ics", "", map[string]string{"If-Match": `"stale"`}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected DELETE with a stale etag to fail, got %d", w.Code)
+	}
+	if w := davRequest(t, r, owner, http.MethodDelete, collection+"lunch.ics", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("expected DELETE to cancel the event, got %d %s", w.Code, w.Body.String())
+	}
+	if slots := findSlots(t, r, users, testDate(1)); len(slots) != 7 {
+		t.Errorf("expected the deleted event to free its slot, got %v", slots)
+	}
+}
+
+func TestCalDAVAuth(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	collection := fmt.Sprintf("/v1/caldav/%d/", users[0])
+	owner := caldavLogin(t, r, users[0])
+	basic := func(username, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	if w := davRequest(t, r, owner, "PROPFIND", collection, "", nil); w.Code != http.StatusMultiStatus {
+		t.Errorf("expected the owner to sign in, got %d %s", w.Code, w.Body.String())
+	}
+	// asking again replaces the password
+	status, response := request(t, r, http.MethodPost, "/v1/user/caldav-password", gin.H{"user_id": users[0]})
+	expectStatus(t, "caldav-password", status, http.StatusOK, response)
+	password := response["password"].(string)
+	renewed := basic(fmt.Sprint(users[0]), password)
+	for _, test := range []struct {
+		what   string
+		auth   string
+		path   string
+		status int
+	}{
+		{"no credentials", "", collection, http.StatusUnauthorized},
+		{"former password", owner, collection, http.StatusUnauthorized},
+		{"wrong password", basic(fmt.Sprint(users[0]), "guess"), collection, http.StatusUnauthorized},
+		{"user without a password", basic(fmt.Sprint(users[1]), ""), fmt.Sprintf("/v1/caldav/%d/", users[1]), http.StatusUnauthorized},
+		{"unknown user", basic("999", "guess"), "/v1/caldav/999/", http.StatusUnauthorized},
+		{"another user's collection", renewed, fmt.Sprintf("/v1/caldav/%d/", users[1]), http.StatusForbidden},
+		{"another user's event", renewed, fmt.Sprintf("/v1/caldav/%d/booking-1.ics", users[1]), http.StatusForbidden},
+		{"unknown collection", renewed, "/v1/caldav/999/", http.StatusForbidden},
+		{"user id", renewed, collection, http.StatusMultiStatus},
+	} {
+		w := davRequest(t, r, test.auth, "PROPFIND", test.path, "", nil)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.what, test.status, w.Code, w.Body.String())
+		}
+		if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("%s: expected a Basic challenge, got %q", test.what, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// the email signs in too, case aside
+	if w := davRequest(t, r, basic("USER1@example.com", password), "PROPFIND", collection, "", nil); w.Code != http.StatusMultiStatus {
+		t.Errorf("expected the email to sign in, got %d %s", w.Code, w.Body.String())
+	}
+	// every method needs the credentials of the collection's owner
+	for method, path := range map[string]string{"REPORT": collection, http.MethodGet: collection + "lunch.ics", http.MethodPut: collection + "lunch.ics", http.MethodDelete: collection + "lunch.ics"} {
+		if w := davRequest(t, r, "", method, path, "", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without credentials: expected 401, got %d", method, w.Code)
+		}
+	}
+	if w := davRequest(t, r, "", http.MethodOptions, collection, "", nil); w.Code != http.StatusOK {
+		t.Errorf("expected OPTIONS without credentials, got %d", w.Code)
+	}
+	status, response = request(t, r, http.MethodPost, "/v1/user/caldav-password", gin.H{"user_id": 999})
+	expectStatus(t, "caldav-password of an unknown user", status, http.StatusBadRequest, response)
+}
+
+func TestFreeBusy(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	idle := mustCreateUser(t, r, "idle")
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "11:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	at := func(days, hour int) string {
+		return testMonday.AddDate(0, 0, days).Add(time.Duration(hour) * time.Hour).Format(time.RFC3339)
+	}
+
+	body := gin.H{"user_ids": []int{users[0], idle}, "from": at(1, 0), "to": at(2, 0)}
+	status, response = request(t, r, http.MethodPost, "/v1/user/free-busy", body)
+	expectStatus(t, "free-busy", status, http.StatusOK, response)
+	expected := map[float64][]string{
+		float64(users[0]): {at(1, 0) + "/" + at(1, 9), at(1, 10) + "/" + at(1, 12), at(1, 17) + "/" + at(2, 0)},
+		float64(idle):     {at(1, 0) + "/" + at(2, 0)},
+	}
+	for _, user := range response["users"].([]any) {
+		user := user.(map[string]any)
+		var busy []string
+		for _, period := range user["busy"].([]any) {
+			period := period.(map[string]any)
+			busy = append(busy, fmt.Sprint(period["start"], "/", period["end"]))
+		}
+		if !slices.Equal(busy, expected[user["user_id"].(float64)]) {
+			t.Errorf("user %v: expected %v, got %v", user["user_id"], expected[user["user_id"].(float64)], busy)
+		}
+		delete(expected, user["user_id"].(float64))
+	}
+	if len(expected) > 0 {
+		t.Errorf("expected every user in %v", response)
+	}
+
+	payload, _ := json.Marshal(gin.H{"user_ids": []int{users[1]}, "from": at(1, 0), "to": at(2, 0), "format": "ics"})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/user/free-busy", bytes.NewReader(payload)))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("expected a calendar, got %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "BEGIN:VFREEBUSY\r\n") || !strings.Contains(w.Body.String(), "FREEBUSY;FBTYPE=BUSY:"+icsDate(1, 10)+"/"+icsDate(1, 12)+"\r\n") {
+		t.Errorf("expected the busy periods, got %s", w.Body.String())
+	}
+
+	for _, body := range []gin.H{
+		{"user_ids": []int{users[0]}, "from": at(2, 0), "to": at(1, 0)},
+		{"user_ids": []int{users[0]}, "from": at(1, 0), "to": at(40, 0)},
+		{"user_ids": []int{users[0]}, "from": testDate(1), "to": testDate(2)},
+		{"user_ids": []int{}, "from": at(1, 0), "to": at(2, 0)},
+		{"user_ids": []int{users[0]}, "from": at(1, 0), "to": at(2, 0), "format": "xml"},
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/free-busy", body)
+		expectStatus(t, fmt.Sprintf("free-busy of %v", body), status, http.StatusBadRequest, response)
+	}
+}
+
+// webhookCall is a request received by a test webhook
+type webhookCall struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// newWebhookReceiver registers a webhook for events served by a test server,
+// respond picks the response to its n-th call (from 1). It returns the calls
+// received so far
+func newWebhookReceiver(t *testing.T, r http.Handler, secret string, events []string, respond func(n int) int) func() []webhookCall {
+	t.Helper()
+	// the receiver listens on the loopback interface
+	allowPrivate := webhookAllowPrivate
+	t.Cleanup(func() { webhookAllowPrivate = allowPrivate })
+	webhookAllowPrivate = true
+	var mu sync.Mutex
+	var calls []webhookCall
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		calls = append(calls, webhookCall{header: req.Header.Clone(), body: body, at: time.Now()})
+		n := len(calls)
+		mu.Unlock()
+		w.WriteHeader(respond(n))
+	}))
+	t.Cleanup(receiver.Close)
+
+	status, response := request(t, r, http.MethodPost, "/v1/webhook", gin.H{"url": receiver.URL, "secret": secret, "events": events})
+	expectStatus(t, "webhook", status, http.StatusOK, response)
+	return func() []webhookCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(calls)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	r := newTestServer(t)
+	delay := webhookRetryDelay
+	t.Cleanup(func() { webhookRetryDelay = delay })
+	webhookRetryDelay = 20 * time.Millisecond
+
+	const secret = "webhook-secret"
+	calls := newWebhookReceiver(t, r, secret, []string{webhookBookingCreated}, func(n int) int {
+		if n <= 2 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	users := createUsers(t, r, 2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	webhookDeliveries.Wait()
+
+	received := calls()
+	if len(received) != 3 {
+		t.Fatalf("expected 2 failed attempts and a delivery, got %d calls", len(received))
+	}
+	for i, call := range received {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(call.body)
+		if signature := "sha256=" + hex.EncodeToString(mac.Sum(nil)); call.header.Get("X-Webhook-Signature") != signature {
+			t.Errorf("attempt %d: signature %q, expected %q", i+1, call.header.Get("X-Webhook-Signature"), signature)
+		}
+		if call.header.Get("X-Webhook-Event") != webhookBookingCreated {
+			t.Errorf("attempt %d: event %q", i+1, call.header.Get("X-Webhook-Event"))
+		}
+		if !bytes.Equal(call.body, received[0].body) || call.header.Get("X-Webhook-ID") != received[0].header.Get("X-Webhook-ID") {
+			t.Errorf("attempt %d is not a retry of the same event", i+1)
+		}
+	}
+	// the n-th retry waits webhookRetryDelay * 2^(n-1)
+	for i := 1; i < len(received); i++ {
+		if wait, least := received[i].at.Sub(received[i-1].at), webhookRetryDelay<<(i-1); wait < least {
+			t.Errorf("retry %d after %s, expected at least %s", i, wait, least)
+		}
+	}
+	var payload struct {
+		Event string `json:"event"`
+		Data  struct {
+			Booking struct {
+				ID int `json:"id"`
+			} `json:"booking"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(received[0].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != webhookBookingCreated || payload.Data.Booking.ID != int(response["id"].(float64)) {
+		t.Errorf("unexpected payload %s", received[0].body)
+	}
+
+	status, response = request(t, r, http.MethodGet, "/v1/webhook/1/deliveries", nil)
+	expectStatus(t, "deliveries", status, http.StatusOK, response)
+	deliveries := response["deliveries"].([]any)
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 logged attempts, got %v", deliveries)
+	}
+	// the latest attempt comes first
+	for i, expected := range []int{http.StatusOK, http.StatusInternalServerError, http.StatusInternalServerError} {
+		delivery := deliveries[i].(map[string]any)
+		if int(delivery["attempt"].(float64)) != 3-i || int(delivery["status_code"].(float64)) != expected {
+			t.Errorf("delivery %d: %v", i, delivery)
+		}
+	}
+
+	// events the webhook isn't subscribed to aren't delivered
+	status, response = request(t, r, http.MethodPost, "/v1/user/cancel-slot", gin.H{"booking_id": payload.Data.Booking.ID})
+	expectStatus(t, "cancel-slot", status, http.StatusOK, response)
+	webhookDeliveries.Wait()
+	if received := calls(); len(received) != 3 {
+		t.Errorf("expected no delivery of the cancellation, got %d calls", len(received))
+	}
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	r := newTestServer(t)
+	delay := webhookRetryDelay
+	t.Cleanup(func() { webhookRetryDelay = delay })
+	webhookRetryDelay = time.Millisecond
+	calls := newWebhookReceiver(t, r, "", []string{webhookBookingCreated}, func(int) int { return http.StatusOK })
+
+	// once private addresses are off, a webhook registered meanwhile isn't
+	// delivered to its loopback receiver
+	webhookAllowPrivate = false
+	for _, target := range []string{
+		"ftp://example.com/hook",
+		"/hook",
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+		"http://10.1.2.3/hook",
+		"https://172.16.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[fe80::1]/hook",
+		"http://[fd00::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+	} {
+		status, response := request(t, r, http.MethodPost, "/v1/webhook", gin.H{"url": target})
+		expectStatus(t, "webhook to "+target, status, http.StatusBadRequest, response)
+	}
+	status, response := request(t, r, http.MethodPost, "/v1/webhook", gin.H{"url": "https://93.184.215.14/hook"})
+	expectStatus(t, "webhook to a public address", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodDelete, "/v1/webhook", gin.H{"webhook_id": response["id"]})
+	expectStatus(t, "delete webhook", status, http.StatusOK, response)
+
+	users := createUsers(t, r, 2)
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	webhookDeliveries.Wait()
+	if received := calls(); len(received) != 0 {
+		t.Errorf("expected no delivery to a loopback receiver, got %d calls", len(received))
+	}
+	status, response = request(t, r, http.MethodGet, "/v1/webhook/1/deliveries", nil)
+	expectStatus(t, "deliveries", status, http.StatusOK, response)
+	deliveries := response["deliveries"].([]any)
+	if len(deliveries) != webhookMaxAttempts {
+		t.Fatalf("expected %d logged attempts, got %v", webhookMaxAttempts, deliveries)
+	}
+	if delivery := deliveries[0].(map[string]any); !strings.Contains(delivery["error"].(string), errWebhookAddress.Error()) {
+		t.Errorf("expected the attempt to be refused at dial time, got %v", delivery)
+	}
+}
+
+// sentMail is an email handed to the fake SMTP server
+type sentMail struct {
+	to     []string
+	header mail.Header
+	text   string
+	invite string
+}
+
+// newMailbox swaps sendMail for a fake and returns the emails sent so far,
+// once the deliveries in flight are done
+func newMailbox(t *testing.T) func() []sentMail {
+	t.Helper()
+	addr, send := smtpAddr, sendMail
+	t.Cleanup(func() {
+		smtpAddr, sendMail = addr, send
+	})
+	var mu sync.Mutex
+	var sent []sentMail
+	smtpAddr = "smtp.example.com:25"
+	sendMail = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		message, err := mail.ReadMessage(bytes.NewReader(msg))
+		if err != nil {
+			t.Errorf("invalid email: %v", err)
+			return err
+		}
+		email := sentMail{to: to, header: message.Header}
+		mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+		if err != nil {
+			t.Errorf("invalid content type: %v", err)
+			return err
+		}
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			body, _ := io.ReadAll(message.Body)
+			email.text = string(body)
+		} else {
+			parts := multipart.NewReader(message.Body, params["boundary"])
+			for {
+				part, err := parts.NextPart()
+				if err != nil {
+					break
+				}
+				body, _ := io.ReadAll(part)
+				if strings.HasPrefix(part.Header.Get("Content-Type"), "text/calendar") {
+					decoded, _ := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(body), "\r\n", ""))
+					email.invite = string(decoded)
+				} else {
+					email.text = string(body)
+				}
+			}
+		}
+		mu.Lock()
+		sent = append(sent, email)
+		mu.Unlock()
+		return nil
+	}
+	return func() []sentMail {
+		mailDeliveries.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(sent)
+	}
+}
+
+func TestMailInvites(t *testing.T) {
+	r := newTestServer(t)
+	sent := newMailbox(t)
+	users := createUsers(t, r, 2)
+
+	body := bookSlotBody(users, testDate(1), "10:00")
+	body["recurrence"] = "FREQ=WEEKLY;COUNT=2"
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", body)
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	invites := sent()
+	if len(invites) != 2 {
+		t.Fatalf("expected an invite per user, got %d emails", len(invites))
+	}
+	recipients := make(map[string]bool)
+	for _, invite := range invites {
+		recipients[strings.Join(invite.to, ",")] = true
+		if !strings.HasPrefix(invite.header.Get("Subject"), "Invitation: ") {
+			t.Errorf("subject %q", invite.header.Get("Subject"))
+		}
+		for _, line := range []string{"METHOD:REQUEST", "UID:series-1@calenderapi", "DTSTART:" + icsDate(1, 10), "RDATE:" + icsDate(8, 10), "STATUS:CONFIRMED"} {
+			if !strings.Contains(invite.invite, line+"\r\n") {
+				t.Errorf("invite to %v lacks %s:\n%s", invite.to, line, invite.invite)
+			}
+		}
+	}
+	if !recipients["user1@example.com"] || !recipients["user2@example.com"] {
+		t.Errorf("invites sent to %v", recipients)
+	}
+
+	status, response = request(t, r, http.MethodPost, "/v1/user/cancel-slot", gin.H{"booking_id": response["id"], "series": true})
+	expectStatus(t, "cancel-slot", status, http.StatusOK, response)
+	cancellations := sent()[len(invites):]
+	if len(cancellations) != 2 {
+		t.Fatalf("expected a cancellation per user, got %d emails", len(cancellations))
+	}
+	for _, cancellation := range cancellations {
+		if !strings.Contains(cancellation.invite, "METHOD:CANCEL\r\n") || strings.Count(cancellation.invite, "STATUS:CANCELLED\r\n") != 2 {
+			t.Errorf("cancellation to %v:\n%s", cancellation.to, cancellation.invite)
+		}
+	}
+
+	// users without an email aren't emailed
+	status, response = request(t, r, http.MethodPost, "/v1/user/set-email", gin.H{"user_id": users[1], "email": "not an email"})
+	expectStatus(t, "set-email", status, http.StatusBadRequest, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/set-email", gin.H{"user_id": users[1], "email": ""})
+	expectStatus(t, "set-email", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(2), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	if emails := sent()[len(invites)+len(cancellations):]; len(emails) != 1 || !slices.Equal(emails[0].to, []string{"user1@example.com"}) {
+		t.Errorf("expected an invite to user1 alone, got %v", emails)
+	}
+}
+
+func TestMailFailureLogged(t *testing.T) {
+	r := newTestServer(t)
+	newMailbox(t)
+	sendMail = func(string, smtp.Auth, string, []string, []byte) error {
+		return errors.New("connection refused")
+	}
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	users := createUsers(t, r, 2)
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	mailDeliveries.Wait()
+	for i, user := range users {
+		if line := fmt.Sprintf("unable to email user %d at user%d@example.com: connection refused", user, i+1); !strings.Contains(logged.String(), line) {
+			t.Errorf("expected %q to be logged, got %q", line, logged.String())
+		}
+	}
+}
+
+func TestReminders(t *testing.T) {
+	r := newTestServer(t)
+	clock := testNow
+	now = func() time.Time { return clock }
+	calls := newWebhookReceiver(t, r, "reminder-secret", []string{webhookBookingReminder}, func(int) int { return http.StatusOK })
+	sent := newMailbox(t)
+	users := createUsers(t, r, 2)
+
+	status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), "10:00"))
+	expectStatus(t, "book-slot", status, http.StatusOK, response)
+	booking := response["id"]
+	invites := len(sent())
+
+	// remind runs the worker at the given time and returns the offsets of the
+	// reminders it sent, along with the number of emails
+	var reminded int
+	remind := func(at time.Time) ([]int, int) {
+		t.Helper()
+		clock = at
+		if err := sendDueReminders(); err != nil {
+			t.Fatal(err)
+		}
+		webhookDeliveries.Wait()
+		received := calls()
+		var offsets []int
+		for _, call := range received[reminded:] {
+			var payload struct {
+				Data struct {
+					OffsetMinutes int `json:"offset_minutes"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(call.body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			offsets = append(offsets, payload.Data.OffsetMinutes)
+		}
+		reminded = len(received)
+		emails := len(sent()) - invites
+		invites += emails
+		return offsets, emails
+	}
+	expect := func(at time.Time, offsets []int, emails int) {
+		t.Helper()
+		sentOffsets, sentEmails := remind(at)
+		if !slices.Equal(sentOffsets, offsets) || sentEmails != emails {
+			t.Fatalf("at %s: expected reminders %v and %d emails, got %v and %d", at, offsets, emails, sentOffsets, sentEmails)
+		}
+	}
+
+	start := testMonday.AddDate(0, 0, 1).Add(10 * time.Hour)
+	expect(testNow, nil, 0)
+	expect(start.Add(-24*time.Hour+time.Minute), []int{24 * 60}, 2)
+	expect(start.Add(-24*time.Hour+2*time.Minute), nil, 0)
+
+	// a restart on the same database doesn't send them again
+	initialize()
+	expect(start.Add(-23*time.Hour), nil, 0)
+	expect(start.Add(-10*time.Minute), []int{15}, 2)
+	initialize()
+	expect(start.Add(-5*time.Minute), nil, 0)
+
+	// a rescheduled booking gets its reminders again, a day later
+	status, response = request(t, r, http.MethodPost, "/v1/user/reschedule-slot", rescheduleBody(booking, testDate(2), "10:00"))
+	expectStatus(t, "reschedule-slot", status, http.StatusOK, response)
+	invites = len(sent())
+	expect(start.Add(-5*time.Minute), nil, 0)
+	expect(start.Add(time.Minute), []int{24 * 60}, 2)
+	expect(start.Add(2*time.Minute), nil, 0)
+	expect(start.Add(24*time.Hour-15*time.Minute), []int{15}, 2)
+	expect(start.Add(24*time.Hour-14*time.Minute), nil, 0)
+}
+
+func TestParseReminderOffsets(t *testing.T) {
+	for value, expected := range map[string][]time.Duration{
+		"24h,15m":     {15 * time.Minute, 24 * time.Hour},
+		"1h, 1h, 30m": {30 * time.Minute, time.Hour},
+		"none":        nil,
+	} {
+		offsets, err := parseReminderOffsets(value)
+		if err != nil || !slices.Equal(offsets, expected) {
+			t.Errorf("%q: expected %v, got %v %v", value, expected, offsets, err)
+		}
+	}
+	for _, value := range []string{"", "15", "30s", "90s", "-15m", "15m,tomorrow"} {
+		if _, err := parseReminderOffsets(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestInvalidReminderOffsetsLogged(t *testing.T) {
+	offsets := reminderOffsets
+	t.Cleanup(func() { reminderOffsets = offsets })
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	t.Setenv("REMINDER_OFFSETS", "15m,tomorrow")
+	newTestServer(t)
+	if !strings.Contains(logged.String(), "REMINDER_OFFSETS ignored") || !slices.Equal(reminderOffsets, offsets) {
+		t.Errorf("expected the offsets to be kept and the error logged, got %v %q", reminderOffsets, logged.String())
+	}
+}
+
+func TestParseICSEvents(t *testing.T) {
+	calendar := func(lines ...string) string {
+		return strings.Join(append(append([]string{"BEGIN:VCALENDAR", "VERSION:2.0"}, lines...), "END:VCALENDAR", ""), "\r\n")
+	}
+	newYork, _ := time.LoadLocation("America/New_York")
+	at := func(loc *time.Location, day, hour int) time.Time {
+		return time.Date(2026, time.November, day, hour, 0, 0, 0, loc)
+	}
+	for _, test := range []struct {
+		what     string
+		content  string
+		expected []icsEvent
+	}{
+		{"VALARM", calendar(
+			"BEGIN:VEVENT", "UID:alarm", "DTSTART:20261103T100000Z",
+			"BEGIN:VALARM", "TRIGGER:-PT15M", "ACTION:DISPLAY", "DURATION:PT5M", "REPEAT:2", "END:VALARM",
+			"DTEND:20261103T110000Z", "END:VEVENT",
+		), []icsEvent{{UID: "alarm", Start: at(time.UTC, 3, 10), End: at(time.UTC, 3, 11)}}},
+		{"VTIMEZONE", calendar(
+			"BEGIN:VTIMEZONE", "TZID:Europe/Paris",
+			"BEGIN:STANDARD", "DTSTART:19701025T030000", "TZOFFSETFROM:+0200", "TZOFFSETTO:+0100", "END:STANDARD",
+			"END:VTIMEZONE",
+			"BEGIN:VEVENT", "UID:after-zone", "DTSTART:20261103T100000Z", "DURATION:PT30M", "END:VEVENT",
+		), []icsEvent{{UID: "after-zone", Start: at(time.UTC, 3, 10), End: at(time.UTC, 3, 10).Add(30 * time.Minute)}}},
+		{"TZID", calendar(
+			"BEGIN:VEVENT", "UID:paris", "DTSTART;TZID=Europe/Paris:20261103T100000", "DTEND;TZID=\"Europe/Paris\":20261103T113000", "END:VEVENT",
+		), []icsEvent{{UID: "paris", Start: at(time.UTC, 3, 9), End: at(time.UTC, 3, 10).Add(30 * time.Minute)}}},
+		{"floating", calendar(
+			"BEGIN:VEVENT", "UID:floating", "DTSTART:20261103T100000", "DTEND:20261103T110000", "END:VEVENT",
+		), []icsEvent{{UID: "floating", Start: at(newYork, 3, 10), End: at(newYork, 3, 11)}}},
+		{"all-day", calendar(
+			"BEGIN:VEVENT", "UID:all-day", "DTSTART;VALUE=DATE:20261103", "END:VEVENT",
+		), []icsEvent{{UID: "all-day", Start: at(newYork, 3, 0), End: at(newYork, 4, 0)}}},
+		{"EXDATE", calendar(
+			"BEGIN:VEVENT", "UID:daily", "DTSTART:20261103T100000Z", "DTEND:20261103T110000Z", "RRULE:FREQ=DAILY;COUNT=5",
+			"EXDATE:20261104T100000Z,20261105T100000Z", "EXDATE;TZID=Europe/Paris:20261106T110000", "END:VEVENT",
+		), []icsEvent{{UID: "daily", Start: at(time.UTC, 3, 10), End: at(time.UTC, 3, 11), Rule: "FREQ=DAILY;COUNT=5", ExDates: []time.Time{at(time.UTC, 4, 10), at(time.UTC, 5, 10), at(time.UTC, 6, 10)}}}},
+		{"RECURRENCE-ID", calendar(
+			"BEGIN:VEVENT", "UID:daily", "RECURRENCE-ID:20261104T100000Z", "DTSTART:20261104T140000Z", "DTEND:20261104T150000Z", "END:VEVENT",
+		), []icsEvent{{UID: "daily", Start: at(time.UTC, 4, 14), End: at(time.UTC, 4, 15), RecurrenceID: at(time.UTC, 4, 10)}}},
+		{"cancelled and transparent", calendar(
+			"BEGIN:VEVENT", "UID:cancelled", "DTSTART:20261103T100000Z", "DTEND:20261103T110000Z", "STATUS:CANCELLED", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:free", "DTSTART:20261103T100000Z", "DTEND:20261103T110000Z", "TRANSP:TRANSPARENT", "END:VEVENT",
+		), nil},
+	} {
+		events, err := parseICSEvents(test.content, newYork)
+		if err != nil {
+			t.Errorf("%s: %v", test.what, err)
+			continue
+		}
+		if !slices.EqualFunc(events, test.expected, func(a, b icsEvent) bool {
+			return a.UID == b.UID && a.Start.Equal(b.Start) && a.End.Equal(b.End) && a.Rule == b.Rule && a.RecurrenceID.Equal(b.RecurrenceID) &&
+				slices.EqualFunc(a.ExDates, b.ExDates, time.Time.Equal)
+		}) {
+			t.Errorf("%s: expected %v, got %v", test.what, test.expected, events)
+		}
+	}
+
+	for what, content := range map[string]string{
+		"not a calendar":   "BEGIN:VEVENT\r\nEND:VEVENT\r\n",
+		"unbalanced END":   calendar("BEGIN:VEVENT", "UID:a", "DTSTART:20261103T100000Z", "END:VALARM", "END:VEVENT"),
+		"missing DTSTART":  calendar("BEGIN:VEVENT", "UID:a", "BEGIN:VALARM", "DTSTART:20261103T100000Z", "END:VALARM", "END:VEVENT"),
+		"invalid EXDATE":   calendar("BEGIN:VEVENT", "UID:a", "DTSTART:20261103T100000Z", "EXDATE:tomorrow", "END:VEVENT"),
+		"invalid DURATION": calendar("BEGIN:VEVENT", "UID:a", "DTSTART:20261103T100000Z", "DURATION:PT", "END:VEVENT"),
+	} {
+		if _, err := parseICSEvents(content, newYork); err == nil {
+			t.Errorf("%s: expected an error", what)
+		}
+	}
+}
+
+func TestAvailabilityConflictsIncludeRules(t *testing.T) {
+	r := newTestServer(t)
+	users := createUsers(t, r, 2)
+	for _, user := range users {
+		status, response := request(t, r, http.MethodPost, "/v1/user/availability-rule", gin.H{
+			"user_id":    strconv.Itoa(user),
+			"recurrence": "FREQ=WEEKLY;BYDAY=TU",
+			"start_date": testDate(0),
+			"windows":    []gin.H{{"start_time_hour": 18, "start_time_minutes": 0, "end_time_hour": 20, "end_time_minutes": 0}},
+		})
+		expectStatus(t, "availability-rule", status, http.StatusOK, response)
+	}
+	var bookings []int
+	for _, slot := range []string{"10:00", "18:00"} {
+		status, response := request(t, r, http.MethodPost, "/v1/user/book-slot", bookSlotBody(users, testDate(1), slot))
+		expectStatus(t, "book-slot "+slot, status, http.StatusOK, response)
+		bookings = append(bookings, int(response["id"].(float64)))
+	}
+
+	// the booking within the rule window still fits once the weekly windows
+	// of tuesday move to the afternoon, the morning one doesn't
+	status, response := request(t, r, http.MethodPut, "/v1/user/availability", gin.H{
+		"user_id": strconv.Itoa(users[0]),
+		"day":     "tuesday",
+		"windows": []gin.H{{"start_time_hour": 13, "start_time_minutes": 0, "end_time_hour": 17, "end_time_minutes": 0}},
+	})
+	expectStatus(t, "availability", status, http.StatusOK, response)
+	if conflicts := conflictIDs(response); !slices.Equal(conflicts, bookings[:1]) {
+		t.Fatalf("expected booking %d to conflict, got %v", bookings[0], conflicts)
+	}
+}
+
+// baselineSchema is the schema, and some data, of the first version, with a
+// booking on the date given as argument
+const baselineSchema = `
+CREATE TABLE calendar_user (
+	id INTEGER NOT NULL PRIMARY KEY,
+	name VARCHAR(20) NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE calendar_user_availability (
+	user_id INTEGER NOT NULL,
+	day TEXT CHECK (day IN ('monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday')) NOT NULL,
+	start_time_hour INTEGER CHECK (start_time_hour > 0 AND start_time_hour < 24) NOT NULL,
+	start_time_minutes INTEGER CHECK (start_time_minutes >= 0 AND start_time_minutes < 60) NOT NULL,
+	end_time_hour INTEGER CHECK (end_time_hour >= 0 AND end_time_hour < 24) NOT NULL,
+	end_time_minutes INTEGER CHECK (end_time_minutes >= 0 AND end_time_minutes < 60) NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, day),
+	FOREIGN KEY (user_id) REFERENCES calendar_user(id)
+);
+CREATE TABLE calendar_user_booked_slots (
+	id INTEGER NOT NULL PRIMARY KEY,
+	user_id_1 INTEGER NOT NULL,
+	user_id_2 INTEGER NOT NULL,
+	date DATE NOT NULL,
+	start_time_hour INTEGER CHECK (start_time_hour > 0 AND start_time_hour < 24) NOT NULL,
+	start_time_minutes INTEGER CHECK (start_time_minutes >= 0 AND start_time_minutes < 60) NOT NULL,
+	end_time_hour INTEGER CHECK (end_time_hour >= 0 AND end_time_hour < 24) NOT NULL,
+	end_time_minutes INTEGER CHECK (end_time_minutes >= 0 AND end_time_minutes < 60) NOT NULL,
+	slot_type TEXT CHECK (slot_type IN ('hourly', 'half-hourly')) NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id_1) REFERENCES calendar_user(id),
+	FOREIGN KEY (user_id_2) REFERENCES calendar_user(id)
+);
+INSERT INTO calendar_user (id, name) VALUES (1, 'alice'), (2, 'bob');
+INSERT INTO calendar_user_availability (user_id, day, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes) VALUES
+	(1, 'tuesday', 9, 0, 12, 0), (2, 'tuesday', 9, 0, 17, 0);
+INSERT INTO calendar_user_booked_slots (user_id_1, user_id_2, date, start_time_hour, start_time_minutes, end_time_hour, end_time_minutes, slot_type) VALUES
+	(2, 1, '%s', 10, 0, 10, 59, 'hourly');`
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	dsn := testDSN(t)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(fmt.Sprintf(baselineSchema, testDate(1))); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	r := newTestServer(t)
+	file = dsn
+	initialize()
+	// migrating again is a no-op
+	initialize()
+
+	// the baseline window is kept and a second one fits on the same weekday
+	status, response := addWindow(t, r, 1, "tuesday", 14, 17)
+	expectStatus(t, "set-availability", status, http.StatusOK, response)
+	status, response = request(t, r, http.MethodPost, "/v1/user/set-email", gin.H{"user_id": 1, "email": "alice@example.com"})
+	expectStatus(t, "set-email", status, http.StatusOK, response)
+	expected := []string{"09:00", "11:00", "14:00", "15:00", "16:00"}
+	if slots := findSlots(t, r, []int{1, 2}, testDate(1)); !slices.Equal(slots, expected) {
+		t.Fatalf("expected the slots %v around the baseline booking, got %v", expected, slots)
+	}
+
+	// the baseline booking, read as UTC
+	status, response = request(t, r, http.MethodPost, "/v1/user/view-schedule", gin.H{"user_id": 1, "date": testDate(1)})
+	expectStatus(t, "view-schedule", status, http.StatusOK, response)
+	if booked := slotStarts(response["booked_slots"]); !slices.Equal(booked, []string{"10:00"}) {
+		t.Errorf("expected the baseline booking at 10:00, got %v", booked)
+	}
+	db, err = sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var startsAt, endsAt string
+	var duration int
+	if err := db.QueryRow("SELECT starts_at, ends_at, duration_minutes FROM calendar_user_booked_slots WHERE id = 1").Scan(&startsAt, &endsAt, &duration); err != nil {
+		t.Fatal(err)
+	}
+	if startsAt != testDate(1)+"T10:00:00Z" || endsAt != testDate(1)+"T11:00:00Z" || duration != 60 {
+		t.Errorf("expected the baseline booking from 10:00 to 11:00 UTC, got %s to %s (%d minutes)", startsAt, endsAt, duration)
+	}
+
+	// the first user organizes the booking, both of them attend it
+	var organizer int
+	if err := db.QueryRow("SELECT organizer_id FROM calendar_user_booked_slots WHERE id = 1").Scan(&organizer); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT user_id FROM calendar_user_booked_slot_attendees WHERE booked_slot_id = 1 ORDER BY user_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var attendees []int
+	for rows.Next() {
+		var attendee int
+		if err := rows.Scan(&attendee); err != nil {
+			t.Fatal(err)
+		}
+		attendees = append(attendees, attendee)
+	}
+	if organizer != 2 || !slices.Equal(attendees, []int{1, 2}) {
+		t.Errorf("expected bob to organize a booking with both users, got %d and %v", organizer, attendees)
+	}
+}
+
+func TestMigrateAvailabilityRuleCounts(t *testing.T) {
+	r := newTestServer(t)
+	user := mustCreateUser(t, r, "ruled")
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// rules with a COUNT used to be stored without an end date
+	for _, recurrence := range []string{"FREQ=WEEKLY;COUNT=3", "FREQ=WEEKLY"} {
+		if _, err := db.Exec(insertAvailabilityRule, user, recurrence, "2027-01-04", nil, 9, 0, 11, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	initialize()
+
+	rows, err := db.Query("SELECT recurrence, date(end_date) FROM calendar_user_availability_rule ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ends []string
+	for rows.Next() {
+		var recurrence string
+		var end sql.NullString
+		if err := rows.Scan(&recurrence, &end); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, recurrence+" "+end.String)
+	}
+	if expected := []string{"FREQ=WEEKLY;COUNT=3 2027-01-18", "FREQ=WEEKLY "}; !slices.Equal(ends, expected) {
+		t.Errorf("expected %q, got %q", expected, ends)
+	}
+}
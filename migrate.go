@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// migrations bring a database created by an earlier version up to the
+// current schema, in order, each one is a no-op when there is nothing to do
+var migrations = []func(tx *sql.Tx) error{
+	migrateAvailabilityWindows,
+	migrateUserColumns,
+	migrateBookedSlots,
+	migrateAvailabilityRuleCounts,
+}
+
+// migrate runs the migrations in a single transaction before the tables are
+// created. Foreign keys are off meanwhile, as tables may be rebuilt, and are
+// checked once all of them ran
+func migrate(db *sql.DB) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, migration := range migrations {
+		if err := migration(tx); err != nil {
+			return err
+		}
+	}
+	violations, err := tx.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer violations.Close()
+	if violations.Next() {
+		var table string
+		var rowID sql.NullInt64
+		if err := violations.Scan(&table, &rowID); err != nil {
+			return err
+		}
+		return fmt.Errorf("migration left a foreign key violation in %s, row %d", table, rowID.Int64)
+	}
+	if err := violations.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableColumns returns the columns of table in order, none when it does not
+// exist
+func tableColumns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, kind       string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// dropTriggers drops every trigger, which may refer to a table being rebuilt,
+// they are created again along with the tables
+func dropTriggers(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT name FROM sqlite_master WHERE type = 'trigger'")
+	if err != nil {
+		return err
+	}
+	var triggers []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		triggers = append(triggers, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range triggers {
+		if _, err := tx.Exec(fmt.Sprintf("DROP TRIGGER %s", name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildTable creates table again from its create statement when its columns
+// differ from the ones of the statement, and copies the rows over. Columns
+// the table lacks are computed with the given expressions, of the former
+// columns, or left NULL
+func rebuildTable(tx *sql.Tx, table, create string, derived map[string]string) error {
+	legacy, err := tableColumns(tx, table)
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+	next := table + "_next"
+	if _, err := tx.Exec(strings.Replace(create, table+" (", next+" (", 1)); err != nil {
+		return err
+	}
+	columns, err := tableColumns(tx, next)
+	if err != nil {
+		return err
+	}
+	if slices.Equal(columns, legacy) {
+		_, err := tx.Exec(fmt.Sprintf("DROP TABLE %s", next))
+		return err
+	}
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		switch {
+		case slices.Contains(legacy, column):
+			values[i] = column
+		case derived[column] != "":
+			values[i] = derived[column]
+		default:
+			values[i] = "NULL"
+		}
+	}
+	if err := dropTriggers(tx); err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", next, strings.Join(columns, ", "), strings.Join(values, ", "), table),
+		fmt.Sprintf("DROP TABLE %s", table),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", next, table),
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateAvailabilityWindows rebuilds calendar_user_availability, which used
+// to be keyed by (user_id, day) and so held a single window per weekday
+func migrateAvailabilityWindows(tx *sql.Tx) error {
+	return rebuildTable(tx, "calendar_user_availability", availabilityCreate, nil)
+}
+
+// addedUserColumns are the columns calendar_user gained after it was first
+// created, NOT NULL ones need a default to be added
+var addedUserColumns = [][2]string{
+	{"time_zone", "TEXT NOT NULL DEFAULT 'UTC'"},
+	{"buffer_before_minutes", "INTEGER NOT NULL DEFAULT 0 CHECK (buffer_before_minutes >= 0)"},
+	{"buffer_after_minutes", "INTEGER NOT NULL DEFAULT 0 CHECK (buffer_after_minutes >= 0)"},
+	{"min_notice_minutes", "INTEGER NOT NULL DEFAULT 0 CHECK (min_notice_minutes >= 0)"},
+	{"max_horizon_days", "INTEGER NOT NULL DEFAULT 0 CHECK (max_horizon_days >= 0)"},
+	{"max_meetings_per_day", "INTEGER NOT NULL DEFAULT 0 CHECK (max_meetings_per_day >= 0)"},
+	{"max_minutes_per_day", "INTEGER NOT NULL DEFAULT 0 CHECK (max_minutes_per_day >= 0)"},
+	{"max_meetings_per_week", "INTEGER NOT NULL DEFAULT 0 CHECK (max_meetings_per_week >= 0)"},
+	{"max_minutes_per_week", "INTEGER NOT NULL DEFAULT 0 CHECK (max_minutes_per_week >= 0)"},
+	{"email", "TEXT NOT NULL DEFAULT ''"},
+	{"caldav_password", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrateUserColumns adds the columns calendar_user lacks
+func migrateUserColumns(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "calendar_user")
+	if err != nil || len(columns) == 0 {
+		return err
+	}
+	for _, column := range addedUserColumns {
+		if slices.Contains(columns, column[0]) {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE calendar_user ADD COLUMN %s %s", column[0], column[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bookings made before time zones existed are in UTC, their absolute times
+// are derived from the date and the hours, the end minute being inclusive
+const (
+	legacyStartsAt string = "strftime('%Y-%m-%dT%H:%M:%SZ', date(date), printf('+%d minutes', start_time_hour * 60 + start_time_minutes))"
+	legacyEndsAt   string = "strftime('%Y-%m-%dT%H:%M:%SZ', date(date), printf('+%d minutes', end_time_hour * 60 + end_time_minutes + 1))"
+)
+
+// bookings used to be between user_id_1 and user_id_2, the first one
+// organizes them and both of them attend them
+const copyLegacyBookedSlotAttendees string = `
+INSERT OR IGNORE INTO calendar_user_booked_slot_attendees (booked_slot_id, user_id)
+SELECT id, user_id_1 FROM calendar_user_booked_slots
+UNION ALL
+SELECT id, user_id_2 FROM calendar_user_booked_slots;`
+
+// migrateBookedSlots rebuilds calendar_user_booked_slots when its columns
+// changed
+func migrateBookedSlots(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "calendar_user_booked_slots")
+	if err != nil || len(columns) == 0 {
+		return err
+	}
+	starts, ends := "starts_at", "ends_at"
+	if !slices.Contains(columns, "starts_at") {
+		starts, ends = legacyStartsAt, legacyEndsAt
+	}
+	if slices.Contains(columns, "user_id_1") {
+		for _, statement := range []string{bookedSlotAttendees, copyLegacyBookedSlotAttendees} {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+	}
+	// the series the bookings refer to
+	if _, err := tx.Exec(bookingSeries); err != nil {
+		return err
+	}
+	return rebuildTable(tx, "calendar_user_booked_slots", bookedSlots, map[string]string{
+		"starts_at":        starts,
+		"ends_at":          ends,
+		"duration_minutes": fmt.Sprintf("(strftime('%%s', %s) - strftime('%%s', %s)) / 60", ends, starts),
+		"organizer_id":     "user_id_1",
+	})
+}
+
+// migrateAvailabilityRuleCounts ends the availability rules with a COUNT on
+// their last occurrence, rules used to be expanded on every lookup instead
+func migrateAvailabilityRuleCounts(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "calendar_user_availability_rule")
+	if err != nil || len(columns) == 0 {
+		return err
+	}
+	rows, err := tx.Query("SELECT id, recurrence, date(start_date) FROM calendar_user_availability_rule WHERE end_date IS NULL")
+	if err != nil {
+		return err
+	}
+	ends := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var recurrence, startDate string
+		if err := rows.Scan(&id, &recurrence, &startDate); err != nil {
+			rows.Close()
+			return err
+		}
+		rule, err := parseRecurrence(recurrence, time.UTC)
+		if err != nil || rule.Count == 0 {
+			continue
+		}
+		start, err := time.Parse("2006-01-02", startDate)
+		if err != nil {
+			continue
+		}
+		// a rule without any occurrence ends on its start date, the lookups
+		// leave its start out
+		last := rule.bounded(start).Until
+		if last.Before(start) {
+			last = start
+		}
+		ends[id] = last.Format("2006-01-02")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, end := range ends {
+		if _, err := tx.Exec("UPDATE calendar_user_availability_rule SET end_date=? WHERE id=?", end, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}